@@ -15,10 +15,62 @@ func (a Admin) DestroyVolumes(names []string) *cmd.XbeeError {
 	volumes := provider.VolumesFromEnvironment(names)
 	ctx := context.Background()
 	for _, vol := range volumes {
-		boxVol := VboxVolumeFrom(vol)
+		boxVol, err := VboxVolumeFrom(vol)
+		if err != nil {
+			return err
+		}
 		if err := boxVol.Delete(ctx); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// ListVms prints VMs created by xbee on this machine, for every environment.
+func (a Admin) ListVms() *cmd.XbeeError {
+	inventory, err := ListXbeeVms(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, envId := range inventory.EnvIds() {
+		log2.Infof("environment %s :", envId)
+		for _, vm := range inventory[envId] {
+			created := "unknown"
+			if !vm.CreatedAt.IsZero() {
+				created = vm.CreatedAt.Local().Format("2006-01-02 15:04")
+			}
+			log2.Infof("\t%-20s %-12s %10s  created %s  (vm %s)", vm.Host, vm.State, humanSize(vm.DiskUsage), created, vm.Name)
+		}
+	}
+	return nil
+}
+
+// CollectGarbage reports what interrupted runs left behind (see FindOrphans), and deletes it when remove is true.
+// gone lists environments known to be deleted: their VMs and networks are orphans too.
+// It must not run while an image is exported, since exports in progress would be reported.
+func (a Admin) CollectGarbage(gone []string, remove bool) *cmd.XbeeError {
+	ctx := context.Background()
+	orphans, err := FindOrphans(ctx, gone)
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		log2.Infof("no orphan found")
+		return nil
+	}
+	log2.Infof("%d orphan(s) found :", len(orphans))
+	for _, o := range orphans {
+		log2.Infof("\t%s", o)
+	}
+	if !remove {
+		log2.Infof("nothing deleted, run again with remove to delete them")
+		return nil
+	}
+	for _, o := range orphans {
+		log2.Infof("delete %s %s", o.Kind, o.Name)
+		if err := o.Remove(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package virtualbox
+
+import (
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"strconv"
+	"strings"
+)
+
+// VboxVersion is the version of the installed VirtualBox, as reported by VBoxManage --version.
+type VboxVersion struct {
+	Major, Minor, Patch int
+}
+
+func ParseVersion(s string) VboxVersion {
+	var result VboxVersion
+	parts := strings.SplitN(extractVersion(strings.TrimSpace(s)), ".", 3)
+	numbers := []*int{&result.Major, &result.Minor, &result.Patch}
+	for i, part := range parts {
+		*numbers[i], _ = strconv.Atoi(part)
+	}
+	return result
+}
+
+func (v VboxVersion) AtLeast(major int, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+func (v VboxVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Feature is a VBoxManage capability which does not exist in every VirtualBox version.
+type Feature struct {
+	Name         string
+	Major, Minor int // first version providing the feature
+}
+
+var (
+	FeatureNatNetwork  = Feature{Name: "NAT networks", Major: 4, Minor: 3}
+	FeatureLinkedClone = Feature{Name: "linked clones", Major: 4, Minor: 1}
+	FeatureScreenshot  = Feature{Name: "screenshots", Major: 4, Minor: 3}
+	FeatureRecording   = Feature{Name: "video recording", Major: 5, Minor: 0}
+)
+
+// Capabilities picks the VBoxManage syntax matching the installed version.
+// VirtualBox 7 renamed many options (--natpf1 became --nat-pf1, --uartmode1 became --uart-mode1...),
+// old spellings are deprecated.
+type Capabilities struct {
+	Version VboxVersion
+}
+
+func CapabilitiesFor(version VboxVersion) *Capabilities {
+	return &Capabilities{Version: version}
+}
+
+// Require fails when feature is not available in installed version.
+func (c *Capabilities) Require(feature Feature) *cmd.XbeeError {
+	if !c.Has(feature) {
+		return cmd.Error("%s : VirtualBox %d.%d or later is required, installed version is %s", feature.Name, feature.Major, feature.Minor, c.Version)
+	}
+	return nil
+}
+
+func (c *Capabilities) Has(feature Feature) bool {
+	return c.Version.AtLeast(feature.Major, feature.Minor)
+}
+
+func (c *Capabilities) v7() bool {
+	return c.Version.AtLeast(7, 0)
+}
+
+// StartArgs gives startvm options for startType (headless, gui, separate).
+func (c *Capabilities) StartArgs(startType string) []string {
+	return []string{"--type", startType}
+}
+
+// NATRuleOption gives the modifyvm option adding or deleting port forwarding rules of adapter.
+func (c *Capabilities) NATRuleOption(adapter int) string {
+	if c.v7() {
+		return fmt.Sprintf("--nat-pf%d", adapter)
+	}
+	return fmt.Sprintf("--natpf%d", adapter)
+}
+
+// NATRuleControl gives the controlvm subcommand changing forwarding rules of adapter on a running VM.
+func (c *Capabilities) NATRuleControl(adapter int) string {
+	return fmt.Sprintf("natpf%d", adapter)
+}
+
+// IntNetArgs gives modifyvm args attaching adapter to internal network name.
+func (c *Capabilities) IntNetArgs(adapter int, name string) []string {
+	if c.v7() {
+		return []string{fmt.Sprintf("--intnet%d=%s", adapter, name)}
+	}
+	return []string{fmt.Sprintf("--intnet%d", adapter), name}
+}
+
+// UARTFileArgs gives modifyvm args sending serial port n (COM1 for 1) to path.
+func (c *Capabilities) UARTFileArgs(n int, path string) []string {
+	mode := fmt.Sprintf("--uartmode%d", n)
+	if c.v7() {
+		mode = fmt.Sprintf("--uart-mode%d", n)
+	}
+	return []string{fmt.Sprintf("--uart%d", n), "0x3F8", "4", mode, "file", path}
+}
+
+// RecordingArgs gives modifyvm args enabling (or disabling when path is empty) video recording of the display to path.
+func (c *Capabilities) RecordingArgs(path string) ([]string, *cmd.XbeeError) {
+	if err := c.Require(FeatureRecording); err != nil {
+		return nil, err
+	}
+	enable, file := "--recording", "--recordingfile"
+	switch {
+	case c.v7():
+		file = "--recording-file"
+	case !c.Version.AtLeast(6, 0):
+		enable, file = "--videocap", "--videocapfile"
+	}
+	if path == "" {
+		return []string{enable, "off"}, nil
+	}
+	return []string{enable, "on", file, path}, nil
+}
+
+// RecordingControl gives the controlvm subcommand starting or stopping video recording of a running VM.
+func (c *Capabilities) RecordingControl() string {
+	if !c.Version.AtLeast(6, 0) {
+		return "videocap"
+	}
+	return "recording"
+}
@@ -0,0 +1,97 @@
+package virtualbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cloudInitResult is /run/cloud-init/result.json, written once cloud-init finished, with or without errors.
+// boot-finished is written in both cases.
+type cloudInitResult struct {
+	V1 struct {
+		Datasource        string              `json:"datasource"`
+		Errors            []string            `json:"errors"`
+		RecoverableErrors map[string][]string `json:"recoverable_errors"` // by log level, cloud-init 23.4 and later
+	} `json:"v1"`
+}
+
+// an error names its module first: ('scripts_user', RuntimeError('Runparts: 1 failures in 1 attempted commands'))
+var cloudInitModuleRegexp = regexp.MustCompile(`^\('([^']+)'`)
+
+// FailedModules returns modules named by errors, in their order.
+func (r *cloudInitResult) FailedModules() (result []string) {
+	seen := map[string]bool{}
+	for _, e := range r.V1.Errors {
+		if m := cloudInitModuleRegexp.FindStringSubmatch(strings.TrimSpace(e)); m != nil && !seen[m[1]] {
+			seen[m[1]] = true
+			result = append(result, m[1])
+		}
+	}
+	return
+}
+
+// waitUntilCloudInitFinished waits for cloud-init, at most XBEE_VBOX_CLOUD_INIT_TIMEOUT (10m by default) within ctx,
+// and fails if one of its modules failed. The wait is bounded by timeout in the guest, so that nothing is left running.
+func (vm *Vm) waitUntilCloudInitFinished(ctx context.Context) *cmd.XbeeError {
+	timeout := envDuration(envCloudInitTimeout, 10*time.Minute)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	log2.Infof("%s : wait until cloud-init finished...", vm.HostName)
+	// exit status is not 0 when cloud-init failed, result.json tells it: only 124, the one of timeout, is kept
+	status, err := vm.conn.RunCommandToOut(fmt.Sprintf("timeout %d cloud-init status --wait --long 2>&1; [ $? -ne 124 ]", int(timeout.Seconds())+1))
+	if err != nil {
+		return vm.withConsole(cmd.Error("%s : cloud-init did not finish within %v : %v\n%s", vm.HostName, timeout.Round(time.Second), err, strings.TrimSpace(status)))
+	}
+	out, err := vm.conn.RunCommandToOut("cat /run/cloud-init/result.json")
+	if err != nil {
+		return cmd.Error("%s : cloud-init finished but its result cannot be read : %v\n%s", vm.HostName, err, strings.TrimSpace(status))
+	}
+	var result cloudInitResult
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		return cmd.Error("%s : unexpected content of /run/cloud-init/result.json : %v", vm.HostName, err)
+	}
+	var levels []string
+	for level := range result.V1.RecoverableErrors {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	for _, level := range levels {
+		for _, message := range result.V1.RecoverableErrors[level] {
+			log2.Warnf("%s : cloud-init %s : %s", vm.HostName, level, message)
+		}
+	}
+	if len(result.V1.Errors) == 0 {
+		log2.Infof("%s : cloud-init finished", vm.HostName)
+		return nil
+	}
+	return vm.cloudInitError(&result, status)
+}
+
+// cloudInitError gives the failing modules, the status of cloud-init and the error lines of its output.
+func (vm *Vm) cloudInitError(result *cloudInitResult, status string) *cmd.XbeeError {
+	modules := result.FailedModules()
+	if len(modules) == 0 {
+		modules = []string{"unknown"}
+	}
+	w := &strings.Builder{}
+	fmt.Fprintf(w, "%s : cloud-init failed in module %s", vm.HostName, strings.Join(modules, ", "))
+	for _, e := range result.V1.Errors {
+		fmt.Fprintf(w, "\n\t%s", e)
+	}
+	if status = strings.TrimSpace(status); status != "" {
+		fmt.Fprintf(w, "\ncloud-init status :\n%s", status)
+	}
+	lines, _ := vm.conn.RunCommandToOut("grep -inE 'error|fail|traceback' /var/log/cloud-init-output.log | tail -n 20")
+	if lines = strings.TrimSpace(lines); lines != "" {
+		fmt.Fprintf(w, "\nfrom /var/log/cloud-init-output.log :\n%s", lines)
+	}
+	return cmd.Error("%s", w.String())
+}
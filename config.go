@@ -0,0 +1,61 @@
+package virtualbox
+
+import (
+	"github.com/iodasolutions/xbee-common/log2"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Provider wide settings are read from the environment, so that they can be set without changing xbee configuration.
+const (
+	envRetryAttempts    = "XBEE_VBOX_RETRY_ATTEMPTS"
+	envRetryDelay       = "XBEE_VBOX_RETRY_DELAY"
+	envRetryMaxDelay    = "XBEE_VBOX_RETRY_MAX_DELAY"
+	envDryRun           = "XBEE_VBOX_DRY_RUN"
+	envJournal          = "XBEE_VBOX_JOURNAL"
+	envRemote           = "XBEE_VBOX_REMOTE"
+	envSettleTimeout    = "XBEE_VBOX_SETTLE_TIMEOUT"
+	envStopTimeout      = "XBEE_VBOX_STOP_TIMEOUT"
+	envParallelism      = "XBEE_VBOX_PARALLELISM"
+	envLinkedClones     = "XBEE_VBOX_LINKED_CLONES"
+	envSSHTimeout       = "XBEE_VBOX_SSH_TIMEOUT"
+	envRecordBoot       = "XBEE_VBOX_RECORD_FIRST_BOOT"
+	envCloudInitTimeout = "XBEE_VBOX_CLOUD_INIT_TIMEOUT"
+	envStartType        = "XBEE_VBOX_START_TYPE"
+)
+
+func envBool(name string) bool {
+	switch strings.ToLower(os.Getenv(name)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+func envInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		log2.Warnf("ignore %s=%s : not an integer", name, value)
+		return defaultValue
+	}
+	return result
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	result, err := time.ParseDuration(value)
+	if err != nil {
+		log2.Warnf("ignore %s=%s : not a duration (examples: 500ms, 2m)", name, value)
+		return defaultValue
+	}
+	return result
+}
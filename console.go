@@ -0,0 +1,37 @@
+package virtualbox
+
+import (
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/newfs"
+	"strings"
+)
+
+// The serial port COM1 of a VM is written to a file of its folder: it is the only output of a guest whose network
+// is broken or whose kernel panicked.
+const (
+	consoleFileName  = "console.log"
+	consoleTailLines = 30 // lines added to errors when the guest cannot be reached
+)
+
+func (vm *Vm) ConsoleFile() newfs.File {
+	return vm.Folder().ChildFile(consoleFileName)
+}
+
+// configureConsole sends COM1 to ConsoleFile. VirtualBox empties it at each start.
+func (vm *Vm) configureConsole(batch *ModifyBatch) {
+	batch.Set("serial console", batch.caps().UARTFileArgs(1, vm.ConsoleFile().String())...)
+}
+
+// ConsoleLog returns the last lines of the serial console, all of them when lines is 0.
+func (vm *Vm) ConsoleLog(lines int) (string, *cmd.XbeeError) {
+	return currentHypervisor().Tail(vm.ConsoleFile().String(), lines)
+}
+
+// withConsole adds the end of the serial console to err, which often tells why the guest cannot be reached.
+func (vm *Vm) withConsole(err *cmd.XbeeError) *cmd.XbeeError {
+	tail, err2 := vm.ConsoleLog(consoleTailLines)
+	if err2 != nil || strings.TrimSpace(tail) == "" {
+		return err
+	}
+	return cmd.Error("%s\nlast lines of serial console %s :\n%s", strings.TrimSpace(err.Error()), vm.ConsoleFile(), strings.TrimRight(tail, "\n"))
+}
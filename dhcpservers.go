@@ -72,6 +72,13 @@ func (ds *DhcpServers) CreateNewDhcpIfNecessary(ctx context.Context) *cmd.XbeeEr
 }
 
 func EnsureXbeenetExist(ctx context.Context) *cmd.XbeeError {
+	caps, err := CurrentCapabilities()
+	if err != nil {
+		return err
+	}
+	if err := caps.Require(FeatureNatNetwork); err != nil {
+		return err
+	}
 	vboxLock.Lock()
 	defer vboxLock.Unlock()
 	dhcps, err := NewDhcpServers(ctx)
@@ -90,7 +97,7 @@ func EnsureXbeenetDeleted(ctx context.Context) *cmd.XbeeError {
 		if err := VboxFrom("").removeDhcpServer(ctx, xbeenetName); err != nil {
 			return err
 		}
-		if err := VboxFrom("").remoteIntNet(ctx); err != nil {
+		if err := VboxFrom("").remoteIntNet(ctx, xbeenetName); err != nil {
 			return err
 		}
 	}
@@ -109,12 +116,13 @@ func NewDhcpServers(ctx context.Context) (result *DhcpServers, err *cmd.XbeeErro
 	}
 	parser := &Parser{content: out}
 	for _, aMap := range parser.asList() {
+		// keys before VirtualBox 6.1 were IP, lowerIPAddress and upperIPAddress
 		dhcp := &DhcpServer{
 			NetworkName:    aMap["NetworkName"],
-			IP:             aMap["Dhcpd IP"],
+			IP:             firstOf(aMap, "Dhcpd IP", "IP"),
 			NetworkMask:    aMap["NetworkMask"],
-			LowerIPAddress: aMap["LowerIPAddress"],
-			UpperIPAddress: aMap["UpperIPAddress"],
+			LowerIPAddress: firstOf(aMap, "LowerIPAddress", "lowerIPAddress"),
+			UpperIPAddress: firstOf(aMap, "UpperIPAddress", "upperIPAddress"),
 		}
 		if aMap["Enabled"] == "Yes" {
 			dhcp.Enabled = true
@@ -126,6 +134,15 @@ func NewDhcpServers(ctx context.Context) (result *DhcpServers, err *cmd.XbeeErro
 	return
 }
 
+func firstOf(aMap map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := aMap[key]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
 func (d *DhcpServer) String() string {
 	list := []string{
 		fmt.Sprintf("NetworkName:%s", d.NetworkName),
@@ -0,0 +1,75 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/newfs"
+	"strings"
+	"time"
+)
+
+// With XBEE_VBOX_RECORD_FIRST_BOOT set, the display of a new VM is recorded to a video of its folder, from its first
+// start until its guest is ready, to debug images which do not boot.
+func RecordFirstBoot() bool {
+	return envBool(envRecordBoot)
+}
+
+func (vm *Vm) RecordingFile() newfs.File {
+	return vm.Folder().ChildFile("first-boot.webm")
+}
+
+func (vm *Vm) configureRecording(batch *ModifyBatch) *cmd.XbeeError {
+	if !RecordFirstBoot() {
+		return nil
+	}
+	args, err := batch.caps().RecordingArgs(vm.RecordingFile().String())
+	if err != nil {
+		return err
+	}
+	batch.Set("recording of first boot", args...)
+	return nil
+}
+
+// stopRecording ends the recording of the first boot once the guest is ready.
+func (vm *Vm) stopRecording(ctx context.Context) *cmd.XbeeError {
+	if !vm.info.Machine().Recording() {
+		return nil
+	}
+	log2.Infof("%s : first boot recorded to %s", vm.HostName, vm.RecordingFile())
+	return vm.Vbox().StopRecording(ctx)
+}
+
+// disableRecording prevents next starts from being recorded, when the first one did not reach stopRecording.
+// vm.info must be the one of the existing VM.
+func (vm *Vm) disableRecording(batch *ModifyBatch) {
+	if !vm.info.Machine().Recording() {
+		return
+	}
+	if args, err := batch.caps().RecordingArgs(""); err == nil {
+		batch.Set("end of first boot recording", args...)
+	}
+}
+
+// Screenshot saves the display of the running VM to a PNG file of its folder, and returns it.
+func (vm *Vm) Screenshot(ctx context.Context) (*newfs.File, *cmd.XbeeError) {
+	png := vm.Folder().ChildFile(fmt.Sprintf("screenshot-%s.png", time.Now().Format("20060102-150405")))
+	if err := vm.Vbox().Screenshot(ctx, png); err != nil {
+		return nil, err
+	}
+	return &png, nil
+}
+
+// withScreenshot adds a screenshot to err: the display shows guests stuck on a GRUB prompt or an fsck question.
+// Its context is not the one of Up, which may be the cause of the failure.
+func (vm *Vm) withScreenshot(err *cmd.XbeeError) *cmd.XbeeError {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	png, err2 := vm.Screenshot(ctx)
+	if err2 != nil {
+		log2.Warnf("%s : cannot take a screenshot of the display : %v", vm.HostName, err2)
+		return err
+	}
+	return cmd.Error("%s\nscreenshot of the display : %s", strings.TrimSpace(err.Error()), png)
+}
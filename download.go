@@ -18,6 +18,10 @@ const bytesToMegaBytes = 1048576.0
 func DownloadIfNotCached(ctx context.Context, rawUrl string) (newfs.File, *cmd.XbeeError) {
 	f := newfs.CachedFileForUrl(rawUrl)
 	if !f.Exists() {
+		if DryRun() {
+			log2.Infof("[dry-run] would download %s to %s", rawUrl, f)
+			return f, nil
+		}
 		log2.Debugf("file %s do not exist in cache", f)
 		err := DoDownload(ctx, rawUrl)
 		return f, err
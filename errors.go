@@ -0,0 +1,201 @@
+package virtualbox
+
+import (
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"regexp"
+	"strings"
+)
+
+// ErrorKind classifies a VBoxManage failure from its result code.
+type ErrorKind int
+
+const (
+	KindUnknown         ErrorKind = iota
+	KindNotFound                  // VBOX_E_OBJECT_NOT_FOUND, missing medium file
+	KindInvalidState              // VBOX_E_INVALID_VM_STATE, VBOX_E_INVALID_OBJECT_STATE
+	KindLocked                    // machine locked by another session, VBOX_E_INVALID_SESSION_STATE
+	KindInUse                     // VBOX_E_OBJECT_IN_USE
+	KindFile                      // VBOX_E_FILE_ERROR, VBOX_E_XML_ERROR
+	KindInvalidArgument           // E_INVALIDARG
+	KindAccessDenied              // E_ACCESSDENIED
+	KindNotSupported              // VBOX_E_NOT_SUPPORTED, E_NOTIMPL
+	KindFailure                   // E_FAIL and internal VirtualBox errors
+	KindSyntax                    // VBoxManage rejected the command line
+)
+
+var kindNames = map[ErrorKind]string{
+	KindUnknown:         "unknown",
+	KindNotFound:        "not found",
+	KindInvalidState:    "invalid state",
+	KindLocked:          "locked",
+	KindInUse:           "in use",
+	KindFile:            "file error",
+	KindInvalidArgument: "invalid argument",
+	KindAccessDenied:    "access denied",
+	KindNotSupported:    "not supported",
+	KindFailure:         "failure",
+	KindSyntax:          "syntax error",
+}
+
+func (k ErrorKind) String() string {
+	return kindNames[k]
+}
+
+// resultCodeKinds maps the symbolic result codes printed by VBoxManage (on windows E_*, elsewhere NS_ERROR_*) to their kind.
+var resultCodeKinds = map[string]ErrorKind{
+	"VBOX_E_OBJECT_NOT_FOUND":      KindNotFound,
+	"VBOX_E_INVALID_VM_STATE":      KindInvalidState,
+	"VBOX_E_VM_ERROR":              KindFailure,
+	"VBOX_E_FILE_ERROR":            KindFile,
+	"VBOX_E_IPRT_ERROR":            KindFailure,
+	"VBOX_E_PDM_ERROR":             KindFailure,
+	"VBOX_E_INVALID_OBJECT_STATE":  KindInvalidState,
+	"VBOX_E_HOST_ERROR":            KindFailure,
+	"VBOX_E_NOT_SUPPORTED":         KindNotSupported,
+	"VBOX_E_XML_ERROR":             KindFile,
+	"VBOX_E_INVALID_SESSION_STATE": KindLocked,
+	"VBOX_E_OBJECT_IN_USE":         KindInUse,
+	"VBOX_E_PASSWORD_INCORRECT":    KindAccessDenied,
+	"VBOX_E_MAXIMUM_REACHED":       KindFailure,
+	"VBOX_E_GSTCTL_GUEST_ERROR":    KindFailure,
+	"VBOX_E_TIMEOUT":               KindFailure,
+	"E_INVALIDARG":                 KindInvalidArgument,
+	"NS_ERROR_INVALID_ARG":         KindInvalidArgument,
+	"E_ACCESSDENIED":               KindAccessDenied,
+	"NS_ERROR_NOT_AVAILABLE":       KindNotSupported,
+	"E_NOTIMPL":                    KindNotSupported,
+	"NS_ERROR_NOT_IMPLEMENTED":     KindNotSupported,
+	"E_FAIL":                       KindFailure,
+	"NS_ERROR_FAILURE":             KindFailure,
+	"E_UNEXPECTED":                 KindFailure,
+	"NS_ERROR_UNEXPECTED":          KindFailure,
+	"E_OUTOFMEMORY":                KindFailure,
+	"NS_ERROR_OUT_OF_MEMORY":       KindFailure,
+	"NS_ERROR_CALL_FAILED":         KindFailure,
+}
+
+// VboxError is a failed VBoxManage invocation, with the diagnostic printed by VBoxManage parsed.
+// A typical output is:
+//
+//	VBoxManage: error: Could not find a registered machine named 'a_env'
+//	VBoxManage: error: Details: code VBOX_E_OBJECT_NOT_FOUND (0x80bb0001), component VirtualBoxWrap, interface IVirtualBox, callee nsISupports
+//	VBoxManage: error: Context: "FindMachine(Bstr(VMNameOrUuid).raw(), machine.asOutParam())" at line 3045 of file VBoxManageInfo.cpp
+type VboxError struct {
+	Args      []string // command line, without the VBoxManage executable
+	Output    string   // raw output
+	Messages  []string // error lines which are neither Details nor Context
+	Code      string   // symbolic result code, VBOX_E_OBJECT_NOT_FOUND for example
+	Hresult   string   // numeric result code, 0x80bb0001 for example
+	Component string
+	Interface string
+	Context   string // API call which failed
+	Kind      ErrorKind
+	cause     error // error returned by the runner
+}
+
+var (
+	detailsRegexp    = regexp.MustCompile(`^Details: code (\S+) \((0x[0-9a-fA-F]+)\), component (\S+), interface (\S+)`)
+	contextRegexp    = regexp.MustCompile(`^Context: "(.*)" at line \d+ of file \S+`)
+	resultCodeRegexp = regexp.MustCompile(`^Result Code: (\S+) \((0x[0-9a-fA-F]+)\)`)
+	progressRegexp   = regexp.MustCompile(`^Progress state: (\S+)`)
+	syntaxMarkers    = []string{"Syntax error", "Unknown option", "Invalid parameter", "Invalid command", "Incorrect number of parameters", "Missing argument", "is required"}
+	notFoundMarkers  = []string{"VERR_FILE_NOT_FOUND", "VERR_PATH_NOT_FOUND", "Could not find a registered machine"}
+	lockedMarkers    = []string{"is already locked", "being locked or unlocked"}
+)
+
+func newVboxError(args []string, output string, cause error) *VboxError {
+	result := &VboxError{
+		Args:   args,
+		Output: output,
+		cause:  cause,
+	}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		index := strings.Index(line, ": error: ")
+		if index == -1 || !strings.HasPrefix(line, "VBoxManage") {
+			continue
+		}
+		line = strings.TrimSpace(line[index+len(": error: "):])
+		if m := detailsRegexp.FindStringSubmatch(line); m != nil {
+			result.Code, result.Hresult, result.Component, result.Interface = m[1], m[2], strings.TrimSuffix(m[3], ","), strings.TrimSuffix(m[4], ",")
+		} else if m := contextRegexp.FindStringSubmatch(line); m != nil {
+			result.Context = m[1]
+		} else if m := resultCodeRegexp.FindStringSubmatch(line); m != nil {
+			result.Code, result.Hresult = m[1], m[2]
+		} else if m := progressRegexp.FindStringSubmatch(line); m != nil {
+			if result.Code == "" {
+				result.Code = m[1]
+			}
+		} else if line != "" {
+			result.Messages = append(result.Messages, line)
+		}
+	}
+	result.Kind = result.classify()
+	return result
+}
+
+func (e *VboxError) classify() ErrorKind {
+	text := strings.Join(e.Messages, "\n")
+	if e.Code == "" {
+		if containsAny(text, syntaxMarkers) {
+			return KindSyntax
+		}
+		if containsAny(text, notFoundMarkers) {
+			return KindNotFound
+		}
+		return KindUnknown
+	}
+	kind := resultCodeKinds[e.Code]
+	switch {
+	case kind == KindFile && containsAny(text, notFoundMarkers):
+		return KindNotFound
+	case kind == KindInvalidState && containsAny(text, lockedMarkers):
+		return KindLocked
+	}
+	return kind
+}
+
+func containsAny(s string, markers []string) bool {
+	for _, marker := range markers {
+		if strings.Contains(s, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *VboxError) Error() string {
+	return fmt.Sprintf("command VBoxManage %s failed : output is :\n%s", strings.Join(e.Args, " "), e.Output)
+}
+
+func (e *VboxError) Unwrap() error {
+	return e.cause
+}
+
+// Message returns the first error line printed by VBoxManage.
+func (e *VboxError) Message() string {
+	if len(e.Messages) > 0 {
+		return e.Messages[0]
+	}
+	if e.cause != nil {
+		return e.cause.Error()
+	}
+	return ""
+}
+
+// XbeeError converts e to the error type used throughout xbee. A nil e gives nil.
+func (e *VboxError) XbeeError() *cmd.XbeeError {
+	if e == nil {
+		return nil
+	}
+	return cmd.Error("%s", e.Error())
+}
+
+func (e *VboxError) NotFound() bool {
+	return e != nil && e.Kind == KindNotFound
+}
+
+func (e *VboxError) InvalidState() bool {
+	return e != nil && (e.Kind == KindInvalidState || e.Kind == KindLocked)
+}
@@ -0,0 +1,721 @@
+package fakevbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type natRule struct {
+	name, proto, hostIP, hostPort, guestIP, guestPort string
+}
+
+func (r natRule) String() string {
+	return strings.Join([]string{r.name, r.proto, r.hostIP, r.hostPort, r.guestIP, r.guestPort}, ",")
+}
+
+type nic struct {
+	kind   string
+	intnet string
+	natnet string
+	mac    string
+	rules  []natRule
+}
+
+type attachment struct {
+	port, device int
+	medium       *medium
+}
+
+type controller struct {
+	name        string
+	kind        string
+	attachments []*attachment
+}
+
+type sharedFolder struct {
+	name, hostPath string
+}
+
+type machine struct {
+	name            string
+	uuid            string
+	osType          string
+	state           string
+	stateChange     time.Time
+	memory          int
+	cpus            int
+	settings        map[string]string
+	nics            map[int]*nic
+	controllers     []*controller
+	sharedFolders   []sharedFolder
+	extraData       map[string]string
+	guestProperties map[string]string
+	lockedFor       int       // number of write locks still refused, see VBoxManage.Lock
+	snapshots       *snapshot // root of the snapshot tree
+	current         *snapshot
+}
+
+func (m *machine) setState(state string) {
+	m.state = state
+	m.stateChange = time.Now().UTC()
+}
+
+// clone copies what modifyvm changes, so that a failing modifyvm leaves the machine untouched as VirtualBox does.
+func (m *machine) clone() *machine {
+	c := *m
+	c.settings = map[string]string{}
+	for k, v := range m.settings {
+		c.settings[k] = v
+	}
+	c.nics = map[int]*nic{}
+	for k, n := range m.nics {
+		cn := *n
+		cn.rules = append([]natRule(nil), n.rules...)
+		c.nics[k] = &cn
+	}
+	return &c
+}
+
+func (m *machine) controller(name string) *controller {
+	for _, c := range m.controllers {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (m *machine) mutable() (string, error) {
+	if m.lockedFor > 0 {
+		m.lockedFor--
+		return machineLocked(m)
+	}
+	switch m.state {
+	case "poweroff", "aborted":
+		return "", nil
+	case "saved":
+		return notMutable(m)
+	default:
+		return machineLocked(m)
+	}
+}
+
+func (m *machine) attachedMedia() (result []*medium) {
+	for _, c := range m.controllers {
+		for _, a := range c.attachments {
+			result = append(result, a.medium)
+		}
+	}
+	return
+}
+
+// allMedia returns media attached to the machine and to its snapshots.
+func (m *machine) allMedia() (result []*medium) {
+	result = m.attachedMedia()
+	m.snapshots.walk(func(s *snapshot) {
+		for _, c := range s.controllers {
+			for _, a := range c.attachments {
+				result = append(result, a.medium)
+			}
+		}
+	})
+	return
+}
+
+func (v *VBoxManage) findMachine(nameOrUUID string) *machine {
+	for _, m := range v.machines {
+		if m.name == nameOrUUID || m.uuid == nameOrUUID {
+			return m
+		}
+	}
+	return nil
+}
+
+func (v *VBoxManage) machineFolder(name string) string {
+	return filepath.Join(v.MachineFolder, name)
+}
+
+func (v *VBoxManage) newMachine(name string, osType string) *machine {
+	m := &machine{
+		name:            name,
+		uuid:            v.nextUUID(),
+		osType:          osType,
+		memory:          128,
+		cpus:            1,
+		settings:        map[string]string{"firmware": "BIOS", "boot1": "floppy", "boot2": "dvd", "boot3": "disk", "boot4": "none"},
+		nics:            map[int]*nic{},
+		extraData:       map[string]string{},
+		guestProperties: map[string]string{},
+	}
+	m.setState("poweroff")
+	m.nic(1).kind = "nat"
+	return m
+}
+
+func (v *VBoxManage) createvm(args []string) (string, error) {
+	_, opts := parse(args)
+	name := opts["--name"]
+	if name == "" {
+		return syntaxError("Parameter --name is required")
+	}
+	settingsFile := filepath.Join(v.machineFolder(name), name+".vbox")
+	if v.findMachine(name) != nil || fileExists(settingsFile) {
+		return fail("VBOX_E_FILE_ERROR", "MachineWrap", "IMachine", "CreateMachine(bstrSettingsFile.raw(), bstrName.raw(), ...)",
+			"Machine settings file '%s' already exists", settingsFile)
+	}
+	m := v.newMachine(name, opts["--ostype"])
+	if err := os.MkdirAll(v.machineFolder(name), 0755); err != nil {
+		return fail("VBOX_E_FILE_ERROR", "MachineWrap", "IMachine", "SaveSettings()", "Could not create the directory '%s' (%v)", v.machineFolder(name), err)
+	}
+	if _, ok := opts["--register"]; ok {
+		v.machines = append(v.machines, m)
+	}
+	return fmt.Sprintf("Virtual machine '%s' is created and registered.\nUUID: %s\nSettings file: '%s'\n", name, m.uuid, settingsFile), nil
+}
+
+func (v *VBoxManage) unregistervm(args []string) (string, error) {
+	pos, opts := parse(args)
+	if len(pos) == 0 {
+		return syntaxError("VM name required")
+	}
+	m := v.findMachine(pos[0])
+	if m == nil {
+		return machineNotFound(pos[0])
+	}
+	if m.state == "running" || m.state == "paused" {
+		return fail("VBOX_E_INVALID_OBJECT_STATE", "MachineWrap", "IMachine", "Unregister(CleanupMode_DetachAllReturnHardDisksOnly, ...)",
+			"Cannot unregister the machine '%s' while it is locked", m.name)
+	}
+	if _, ok := opts["--delete"]; ok {
+		owned := map[*medium]bool{}
+		for _, md := range m.allMedia() {
+			if md.kind == "hdd" {
+				owned[md] = true
+			}
+		}
+		for _, md := range v.media {
+			if md.parent != nil && owned[md.parent] && !owned[md] {
+				return fail("VBOX_E_OBJECT_IN_USE", "MachineWrap", "IMachine", "DeleteConfig(ComSafeArrayAsInParam(aMedia), pProgress.asOutParam())",
+					"Cannot delete storage: medium '%s' is still attached to the following 1 virtual machine(s): %s", md.parent.location, v.usersOf(md)[0].name)
+			}
+		}
+		for md := range owned {
+			v.removeMedium(md)
+			_ = os.Remove(md.location)
+		}
+		_ = os.RemoveAll(v.machineFolder(m.name))
+	}
+	for i, other := range v.machines {
+		if other == m {
+			v.machines = append(v.machines[:i], v.machines[i+1:]...)
+			break
+		}
+	}
+	return "", nil
+}
+
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+func (v *VBoxManage) showvminfo(args []string) (string, error) {
+	pos, opts := parse(args)
+	if len(pos) == 0 {
+		return syntaxError("VM name required")
+	}
+	m := v.findMachine(pos[0])
+	if m == nil {
+		return machineNotFound(pos[0])
+	}
+	if _, ok := opts["--machinereadable"]; !ok {
+		return fmt.Sprintf("Name:                        %s\nUUID:                        %s\nState:                       %s\n", m.name, m.uuid, m.state), nil
+	}
+	w := &strings.Builder{}
+	line := func(key string, value string) {
+		fmt.Fprintf(w, "%s=%s\n", key, quote(value))
+	}
+	folder := v.machineFolder(m.name)
+	line("name", m.name)
+	line("groups", "/")
+	line("ostype", m.osType)
+	line("UUID", m.uuid)
+	line("CfgFile", filepath.Join(folder, m.name+".vbox"))
+	line("SnapFldr", filepath.Join(folder, "Snapshots"))
+	line("LogFldr", filepath.Join(folder, "Logs"))
+	fmt.Fprintf(w, "memory=%d\n", m.memory)
+	fmt.Fprintf(w, "cpus=%d\n", m.cpus)
+	line("firmware", m.settings["firmware"])
+	for i := 1; i <= 4; i++ {
+		line(fmt.Sprintf("boot%d", i), m.settings[fmt.Sprintf("boot%d", i)])
+	}
+	line("VMState", m.state)
+	line("VMStateChangeTime", m.stateChange.Format("2006-01-02T15:04:05.000000000"))
+	for i, c := range m.controllers {
+		line(fmt.Sprintf("storagecontrollername%d", i), c.name)
+		line(fmt.Sprintf("storagecontrollertype%d", i), c.kind)
+		line(fmt.Sprintf("storagecontrollerinstance%d", i), "0")
+		line(fmt.Sprintf("storagecontrollermaxportcount%d", i), strconv.Itoa(c.portCount()))
+		line(fmt.Sprintf("storagecontrollerportcount%d", i), strconv.Itoa(c.portCount()))
+		line(fmt.Sprintf("storagecontrollerbootable%d", i), "on")
+	}
+	for _, c := range m.controllers {
+		for port := 0; port < c.portCount(); port++ {
+			for device := 0; device < c.deviceCount(); device++ {
+				key := fmt.Sprintf("%s-%d-%d", c.name, port, device)
+				if a := c.attachment(port, device); a != nil {
+					fmt.Fprintf(w, "%s=%s\n", quote(key), quote(a.medium.location))
+					fmt.Fprintf(w, "%s=%s\n", quote(fmt.Sprintf("%s-ImageUUID-%d-%d", c.name, port, device)), quote(a.medium.uuid))
+				} else {
+					fmt.Fprintf(w, "%s=%s\n", quote(key), quote("none"))
+				}
+			}
+		}
+	}
+	for i := 1; i <= 8; i++ {
+		n, ok := m.nics[i]
+		if !ok || n.kind == "none" {
+			line(fmt.Sprintf("nic%d", i), "none")
+			continue
+		}
+		if n.kind == "nat" {
+			line(fmt.Sprintf("natnet%d", i), "nat")
+		}
+		line(fmt.Sprintf("macaddress%d", i), n.mac)
+		line(fmt.Sprintf("cableconnected%d", i), "on")
+		line(fmt.Sprintf("nic%d", i), n.kind)
+		switch n.kind {
+		case "intnet":
+			line(fmt.Sprintf("intnet%d", i), n.intnet)
+		case "natnetwork":
+			line(fmt.Sprintf("nat-network%d", i), n.natnet)
+		}
+		line(fmt.Sprintf("nictype%d", i), "82540EM")
+		line(fmt.Sprintf("nicspeed%d", i), "0")
+		if n.kind == "nat" {
+			for j, r := range n.rules {
+				line(fmt.Sprintf("Forwarding(%d)", j), r.String())
+			}
+		}
+	}
+	line("uart1", m.settingOr("uart1", "off"))
+	if mode, ok := m.settings["uartmode1"]; ok {
+		line("uartmode1", mode)
+	}
+	line("recording_enabled", m.settingOr("recording", "off"))
+	if file, ok := m.settings["recordingfile"]; ok {
+		line("recording_file", file)
+	}
+	for i, sf := range m.sharedFolders {
+		line(fmt.Sprintf("SharedFolderNameMachineMapping%d", i+1), sf.name)
+		line(fmt.Sprintf("SharedFolderPathMachineMapping%d", i+1), sf.hostPath)
+	}
+	m.snapshots.write(w, "", m.current)
+	if m.current != nil {
+		line("CurrentSnapshotName", m.current.name)
+		line("CurrentSnapshotUUID", m.current.uuid)
+	}
+	return w.String(), nil
+}
+
+func (m *machine) settingOr(key string, defaultValue string) string {
+	if value, ok := m.settings[key]; ok {
+		return value
+	}
+	return defaultValue
+}
+
+func (c *controller) portCount() int {
+	if c.kind == "PIIX4" {
+		return 2
+	}
+	return 30
+}
+
+func (c *controller) deviceCount() int {
+	if c.kind == "PIIX4" {
+		return 2
+	}
+	return 1
+}
+
+func (c *controller) attachment(port int, device int) *attachment {
+	for _, a := range c.attachments {
+		if a.port == port && a.device == device {
+			return a
+		}
+	}
+	return nil
+}
+
+// nicOption splits options such as --natpf1, --nat-pf1 or --intnet2 into their name and adapter number.
+func nicOption(option string) (name string, index int) {
+	trimmed := strings.TrimRight(option, "0123456789")
+	index, _ = strconv.Atoi(option[len(trimmed):])
+	return strings.ReplaceAll(strings.TrimPrefix(trimmed, "--"), "-", ""), index
+}
+
+func (v *VBoxManage) modifyvm(args []string) (string, error) {
+	if len(args) == 0 {
+		return syntaxError("VM name required")
+	}
+	m := v.findMachine(args[0])
+	if m == nil {
+		return machineNotFound(args[0])
+	}
+	if out, err := m.mutable(); err != nil {
+		return out, err
+	}
+	c := m.clone()
+	args = args[1:]
+	for i := 0; i < len(args); i++ {
+		option := args[i]
+		if !strings.HasPrefix(option, "-") {
+			return syntaxError("Invalid parameter '%s'", option)
+		}
+		option = "--" + strings.TrimLeft(option, "-")
+		var values []string
+		if key, value, ok := strings.Cut(option, "="); ok {
+			option = key
+			values = append(values, value)
+		}
+		for i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			values = append(values, args[i+1])
+			i++
+		}
+		if len(values) == 0 {
+			return syntaxError("Missing argument to '%s'", option)
+		}
+		if out, err := c.modify(option, values); err != nil {
+			return out, err
+		}
+	}
+	if c.name != m.name {
+		if v.findMachine(c.name) != nil {
+			return fail("VBOX_E_FILE_ERROR", "MachineWrap", "IMachine", "SaveSettings()", "Machine '%s' already exists", c.name)
+		}
+		oldFolder, newFolder := v.machineFolder(m.name), v.machineFolder(c.name)
+		if err := os.Rename(oldFolder, newFolder); err != nil && !os.IsNotExist(err) {
+			return fail("VBOX_E_FILE_ERROR", "MachineWrap", "IMachine", "SaveSettings()", "Could not rename the directory '%s' to '%s' (%v)", oldFolder, newFolder, err)
+		}
+		for _, md := range v.media {
+			if rel, err := filepath.Rel(oldFolder, md.location); err == nil && !strings.HasPrefix(rel, "..") {
+				md.location = filepath.Join(newFolder, rel)
+			}
+		}
+	}
+	*m = *c
+	return "", nil
+}
+
+func (m *machine) nic(index int) *nic {
+	n, ok := m.nics[index]
+	if !ok {
+		n = &nic{kind: "none", mac: fmt.Sprintf("080027%s%02X", strings.ToUpper(m.uuid[len(m.uuid)-4:]), index)}
+		m.nics[index] = n
+	}
+	return n
+}
+
+func (m *machine) modify(option string, values []string) (string, error) {
+	name, index := nicOption(option)
+	switch {
+	case option == "--memory":
+		memory, err := strconv.Atoi(values[0])
+		if err != nil {
+			return syntaxError("Invalid memory size '%s'", values[0])
+		}
+		m.memory = memory
+	case option == "--name":
+		m.name = values[0]
+	case option == "--cpus":
+		cpus, err := strconv.Atoi(values[0])
+		if err != nil {
+			return syntaxError("Invalid number of cpus '%s'", values[0])
+		}
+		m.cpus = cpus
+	case index > 0 && name == "nic":
+		m.nic(index).kind = values[0]
+	case index > 0 && name == "intnet":
+		m.nic(index).intnet = values[0]
+	case index > 0 && name == "natnetwork":
+		m.nic(index).natnet = values[0]
+	case index > 0 && name == "natpf":
+		n := m.nic(index)
+		if values[0] == "delete" {
+			if len(values) < 2 {
+				return syntaxError("Missing rule name to delete")
+			}
+			for i, r := range n.rules {
+				if r.name == values[1] {
+					n.rules = append(n.rules[:i], n.rules[i+1:]...)
+					return "", nil
+				}
+			}
+			return fail("E_INVALIDARG", "NATEngineWrap", "INATEngine", "RemoveRedirect(Bstr(ValueUnion.psz).raw())",
+				"A NAT rule of this name does not exist")
+		}
+		parts := strings.Split(values[0], ",")
+		if len(parts) != 6 {
+			return syntaxError("Invalid NAT rule '%s'", values[0])
+		}
+		rule := natRule{name: parts[0], proto: parts[1], hostIP: parts[2], hostPort: parts[3], guestIP: parts[4], guestPort: parts[5]}
+		for _, r := range n.rules {
+			if r.name == rule.name {
+				return fail("E_INVALIDARG", "NATEngineWrap", "INATEngine", "AddRedirect(...)", "A NAT rule of this name already exists")
+			}
+			if r.hostPort == rule.hostPort && r.hostIP == rule.hostIP && r.proto == rule.proto {
+				return fail("E_INVALIDARG", "NATEngineWrap", "INATEngine", "AddRedirect(...)", "A NAT rule for this host port and this host IP already exists")
+			}
+		}
+		n.rules = append(n.rules, rule)
+		sort.SliceStable(n.rules, func(i, j int) bool { return n.rules[i].name < n.rules[j].name })
+	default:
+		m.settings[strings.ReplaceAll(strings.TrimPrefix(option, "--"), "-", "")] = strings.Join(values, ",")
+	}
+	return "", nil
+}
+
+func (v *VBoxManage) storagectl(args []string) (string, error) {
+	pos, opts := parse(args)
+	if len(pos) == 0 {
+		return syntaxError("VM name required")
+	}
+	m := v.findMachine(pos[0])
+	if m == nil {
+		return machineNotFound(pos[0])
+	}
+	if out, err := m.mutable(); err != nil {
+		return out, err
+	}
+	name := opts["--name"]
+	if _, ok := opts["--remove"]; ok {
+		for i, c := range m.controllers {
+			if c.name == name {
+				m.controllers = append(m.controllers[:i], m.controllers[i+1:]...)
+				return "", nil
+			}
+		}
+		return fail("VBOX_E_OBJECT_NOT_FOUND", "SessionMachine", "IMachine", "RemoveStorageController(Bstr(pszCtl).raw())",
+			"Could not find a storage controller named '%s'", name)
+	}
+	if m.controller(name) != nil {
+		return fail("VBOX_E_OBJECT_IN_USE", "SessionMachine", "IMachine", "AddStorageController(Bstr(pszCtl).raw(), StorageBus_SATA, ctl.asOutParam())",
+			"Storage controller named '%s' already exists", name)
+	}
+	kind := "IntelAhci"
+	if strings.EqualFold(opts["--add"], "ide") {
+		kind = "PIIX4"
+	}
+	m.controllers = append(m.controllers, &controller{name: name, kind: kind})
+	return "", nil
+}
+
+func (v *VBoxManage) storageattach(args []string) (string, error) {
+	pos, opts := parse(args)
+	if len(pos) == 0 {
+		return syntaxError("VM name required")
+	}
+	m := v.findMachine(pos[0])
+	if m == nil {
+		return machineNotFound(pos[0])
+	}
+	if out, err := m.mutable(); err != nil && !(m.state == "running" && opts["--type"] == "dvddrive") {
+		return out, err
+	}
+	c := m.controller(opts["--storagectl"])
+	if c == nil {
+		return fail("VBOX_E_OBJECT_NOT_FOUND", "SessionMachine", "IMachine", "GetStorageControllerByName(Bstr(pszCtl).raw(), storageCtl.asOutParam())",
+			"Could not find a controller named '%s'", opts["--storagectl"])
+	}
+	port, _ := strconv.Atoi(opts["--port"])
+	device, _ := strconv.Atoi(opts["--device"])
+	location := opts["--medium"]
+	current := c.attachment(port, device)
+	if location == "none" || location == "emptydrive" {
+		if current == nil {
+			return fail("VBOX_E_OBJECT_NOT_FOUND", "SessionMachine", "IMachine", "DetachDevice(Bstr(pszCtl).raw(), port, device)",
+				"No storage device attached to device slot %d on port %d of controller '%s'", device, port, c.name)
+		}
+		for i, a := range c.attachments {
+			if a == current {
+				c.attachments = append(c.attachments[:i], c.attachments[i+1:]...)
+				break
+			}
+		}
+		return "", nil
+	}
+	kind := "hdd"
+	if opts["--type"] == "dvddrive" {
+		kind = "dvd"
+	}
+	md, out, err := v.openMedium(kind, location)
+	if err != nil {
+		return out, err
+	}
+	if mtype, ok := opts["--mtype"]; ok {
+		md.mtype = mtype
+	}
+	if current != nil {
+		current.medium = md
+	} else {
+		c.attachments = append(c.attachments, &attachment{port: port, device: device, medium: md})
+	}
+	return "", nil
+}
+
+func (v *VBoxManage) sharedfolder(args []string) (string, error) {
+	if len(args) < 2 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	pos, opts := parse(args[1:])
+	if len(pos) == 0 {
+		return syntaxError("VM name required")
+	}
+	m := v.findMachine(pos[0])
+	if m == nil {
+		return machineNotFound(pos[0])
+	}
+	name := opts["--name"]
+	switch args[0] {
+	case "add":
+		for _, sf := range m.sharedFolders {
+			if sf.name == name {
+				return fail("VBOX_E_OBJECT_IN_USE", "SharedFolderWrap", "IMachine", "CreateSharedFolder(...)",
+					"Shared folder named '%s' already exists", name)
+			}
+		}
+		m.sharedFolders = append(m.sharedFolders, sharedFolder{name: name, hostPath: opts["--hostpath"]})
+	case "remove":
+		for i, sf := range m.sharedFolders {
+			if sf.name == name {
+				m.sharedFolders = append(m.sharedFolders[:i], m.sharedFolders[i+1:]...)
+				return "", nil
+			}
+		}
+		return fail("VBOX_E_OBJECT_NOT_FOUND", "SessionMachine", "IMachine", "RemoveSharedFolder(Bstr(name).raw())",
+			"Could not find a shared folder named '%s'", name)
+	default:
+		return syntaxError("Invalid parameter '%s'", args[0])
+	}
+	return "", nil
+}
+
+func (v *VBoxManage) startvm(args []string) (string, error) {
+	pos, _ := parse(args)
+	if len(pos) == 0 {
+		return syntaxError("VM name required")
+	}
+	m := v.findMachine(pos[0])
+	if m == nil {
+		return machineNotFound(pos[0])
+	}
+	switch m.state {
+	case "poweroff", "aborted", "saved":
+	default:
+		return fail("VBOX_E_INVALID_OBJECT_STATE", "MachineWrap", "IMachine", "LaunchVMProcess(a->session, sessionType.raw(), ...)",
+			"The machine '%s' is already locked by a session (or being locked or unlocked)", m.name)
+	}
+	// as VirtualBox, the file of a serial port is emptied at each start; the fake guest only writes its boot line
+	if path, ok := strings.CutPrefix(m.settings["uartmode1"], "file,"); ok {
+		if err := os.WriteFile(path, []byte("[    0.000000] Linux version fake ("+m.name+")\n"), 0644); err != nil {
+			return fail("VBOX_E_FILE_ERROR", "Console", "IConsole", "PowerUp()", "Failed to open the serial port file '%s' (%v)", path, err)
+		}
+	}
+	m.setState("running")
+	return fmt.Sprintf("Waiting for VM \"%s\" to power on...\nVM \"%s\" has been successfully started.\n", m.name, m.name), nil
+}
+
+func (v *VBoxManage) controlvm(args []string) (string, error) {
+	if len(args) < 2 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	m := v.findMachine(args[0])
+	if m == nil {
+		return machineNotFound(args[0])
+	}
+	crashed := m.state == "gurumeditation" || m.state == "stuck"
+	if m.state != "running" && m.state != "paused" && !(crashed && args[1] == "poweroff") {
+		return fail("VBOX_E_INVALID_VM_STATE", "ConsoleWrap", "IConsole", "LockMachine(a->session, LockType_Shared)",
+			"Machine '%s' is not currently running", m.name)
+	}
+	switch args[1] {
+	case "poweroff", "acpipowerbutton":
+		m.setState("poweroff")
+	case "pause":
+		m.setState("paused")
+	case "resume":
+		m.setState("running")
+	case "savestate":
+		m.setState("saved")
+	case "recording":
+		if len(args) < 3 {
+			return syntaxError("Missing argument to 'recording'")
+		}
+		m.settings["recording"] = args[2]
+	case "screenshotpng":
+		if len(args) < 3 {
+			return syntaxError("Missing argument to 'screenshotpng'")
+		}
+		if err := os.WriteFile(args[2], []byte("\x89PNG\r\n\x1a\n"), 0644); err != nil {
+			return fail("VBOX_E_FILE_ERROR", "ConsoleWrap", "IDisplay", "TakeScreenShotToArray(...)", "Failed to write the file '%s' (%v)", args[2], err)
+		}
+	default:
+		if name, index := nicOption("--" + args[1]); index > 0 && name == "natpf" {
+			c := m.clone()
+			if out, err := c.modify("--natpf"+strconv.Itoa(index), args[2:]); err != nil {
+				return out, err
+			}
+			m.nics = c.nics
+		}
+	}
+	return "", nil
+}
+
+func (v *VBoxManage) discardstate(args []string) (string, error) {
+	if len(args) == 0 {
+		return syntaxError("VM name required")
+	}
+	m := v.findMachine(args[0])
+	if m == nil {
+		return machineNotFound(args[0])
+	}
+	if m.state != "saved" {
+		return fail("VBOX_E_INVALID_VM_STATE", "MachineWrap", "IMachine", "DiscardSavedState(true)",
+			"Cannot discard the saved state as the machine is not in the Saved state (machine state: %s)", m.state)
+	}
+	m.setState("poweroff")
+	return "", nil
+}
+
+func (v *VBoxManage) guestproperty(args []string) (string, error) {
+	if len(args) < 3 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	m := v.findMachine(args[1])
+	if m == nil {
+		return machineNotFound(args[1])
+	}
+	switch args[0] {
+	case "get":
+		if value, ok := m.guestProperties[args[2]]; ok {
+			return fmt.Sprintf("Value: %s\n", value), nil
+		}
+		return "No value set!\n", nil
+	case "set":
+		if len(args) > 3 {
+			m.guestProperties[args[2]] = args[3]
+		} else {
+			delete(m.guestProperties, args[2])
+		}
+		return "", nil
+	default:
+		return syntaxError("Invalid parameter '%s'", args[0])
+	}
+}
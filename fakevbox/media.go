@@ -0,0 +1,453 @@
+package fakevbox
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type medium struct {
+	location string
+	uuid     string
+	kind     string // hdd or dvd
+	format   string
+	size     int // MB
+	parent   *medium
+	mtype    string // normal when empty, writethrough disks are left out of snapshots
+}
+
+// root returns the base medium of a differencing chain, the one holding data in this fake.
+func (md *medium) root() *medium {
+	for md.parent != nil {
+		md = md.parent
+	}
+	return md
+}
+
+type natNetwork struct {
+	name    string
+	network string
+	enabled bool
+}
+
+type dhcpServer struct {
+	netName, ip, mask, lower, upper string
+	enabled                         bool
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+func (n *natNetwork) write(w io.Writer) {
+	fmt.Fprintf(w, "Name:         %s\n", n.name)
+	fmt.Fprintf(w, "Network:      %s\n", n.network)
+	fmt.Fprintf(w, "Gateway:      %s\n", strings.TrimSuffix(n.network, ".0/24")+".1")
+	fmt.Fprintf(w, "DHCP Server:  %s\n", yesNo(true))
+	fmt.Fprintf(w, "IPv6:         %s\n", yesNo(false))
+	fmt.Fprintf(w, "Enabled:      %s\n", yesNo(n.enabled))
+}
+
+func (d *dhcpServer) write(w io.Writer) {
+	fmt.Fprintf(w, "NetworkName:    %s\n", d.netName)
+	fmt.Fprintf(w, "Dhcpd IP:       %s\n", d.ip)
+	fmt.Fprintf(w, "LowerIPAddress: %s\n", d.lower)
+	fmt.Fprintf(w, "UpperIPAddress: %s\n", d.upper)
+	fmt.Fprintf(w, "NetworkMask:    %s\n", d.mask)
+	fmt.Fprintf(w, "Enabled:        %s\n", yesNo(d.enabled))
+	fmt.Fprintf(w, "Global Configuration:\n")
+	fmt.Fprintf(w, "    minLeaseTime:     default\n")
+	fmt.Fprintf(w, "    defaultLeaseTime: default\n")
+	fmt.Fprintf(w, "    maxLeaseTime:     default\n")
+	fmt.Fprintf(w, "    Forced options:   None\n")
+	fmt.Fprintf(w, "    Suppressed opts.: None\n")
+	fmt.Fprintf(w, "        1/legacy: %s\n", d.mask)
+	fmt.Fprintf(w, "Groups:               None\n")
+	fmt.Fprintf(w, "Individual Configs:   None\n")
+}
+
+func (v *VBoxManage) writeMedium(w io.Writer, md *medium, long bool) {
+	fmt.Fprintf(w, "UUID:           %s\n", md.uuid)
+	mtype := md.mtype
+	if mtype == "" {
+		mtype = "normal"
+	}
+	if md.parent != nil {
+		fmt.Fprintf(w, "Parent UUID:    %s\n", md.parent.uuid)
+		fmt.Fprintf(w, "State:          created\n")
+		fmt.Fprintf(w, "Type:           %s (differencing)\n", mtype)
+	} else {
+		fmt.Fprintf(w, "Parent UUID:    base\n")
+		fmt.Fprintf(w, "State:          created\n")
+		fmt.Fprintf(w, "Type:           %s (base)\n", mtype)
+	}
+	fmt.Fprintf(w, "Location:       %s\n", md.location)
+	if md.kind == "hdd" {
+		fmt.Fprintf(w, "Storage format: %s\n", md.format)
+		fmt.Fprintf(w, "Capacity:       %d MBytes\n", md.size)
+		if long {
+			var size int64
+			if info, err := os.Stat(md.location); err == nil {
+				size = info.Size()
+			}
+			fmt.Fprintf(w, "Size on disk:   %d MBytes\n", (size+1<<20-1)>>20)
+		}
+	}
+	fmt.Fprintf(w, "Encryption:     disabled\n")
+	if users := v.usersOf(md); len(users) > 0 {
+		var names []string
+		for _, m := range users {
+			names = append(names, fmt.Sprintf("%s (UUID: %s)", m.name, m.uuid))
+		}
+		fmt.Fprintf(w, "In use by VMs:  %s\n", strings.Join(names, ", "))
+	}
+}
+
+func (v *VBoxManage) findMedium(location string) *medium {
+	for _, md := range v.media {
+		if md.location == location || md.uuid == location {
+			return md
+		}
+	}
+	return nil
+}
+
+func (v *VBoxManage) usersOf(md *medium) (result []*machine) {
+	for _, m := range v.machines {
+		for _, other := range m.allMedia() {
+			if other == md {
+				result = append(result, m)
+				break
+			}
+		}
+	}
+	return
+}
+
+// openMedium returns the registered medium at location, registering it first when the file exists.
+func (v *VBoxManage) openMedium(kind string, location string) (*medium, string, error) {
+	if md := v.findMedium(location); md != nil {
+		return md, "", nil
+	}
+	if !fileExists(location) {
+		out, err := fail("VBOX_E_FILE_ERROR", "MediumWrap", "IMedium", "OpenMedium(Bstr(pszFilenameOrUuid).raw(), enmDevType, enmAccessMode, fForceNewUuidOnOpen, pMedium.asOutParam())",
+			"Could not find file for the medium '%s' (VERR_FILE_NOT_FOUND)", location)
+		return nil, out, err
+	}
+	md := &medium{location: location, uuid: v.nextUUID(), kind: kind, format: strings.ToUpper(strings.TrimPrefix(filepath.Ext(location), "."))}
+	v.media = append(v.media, md)
+	return md, "", nil
+}
+
+func (v *VBoxManage) removeMedium(md *medium) {
+	for i, other := range v.media {
+		if other == md {
+			v.media = append(v.media[:i], v.media[i+1:]...)
+			return
+		}
+	}
+}
+
+func createFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (v *VBoxManage) createmedium(args []string) (string, error) {
+	_, opts := parse(args)
+	location := opts["--filename"]
+	if err := createFile(location); err != nil {
+		return fail("VBOX_E_FILE_ERROR", "MediumWrap", "IMedium", "CreateBaseStorage(size, (ULONG)cVariants, variants, pProgress.asOutParam())",
+			"Could not create the medium storage unit '%s' (%v)", location, err)
+	}
+	size, _ := strconv.Atoi(opts["--size"])
+	format := opts["--format"]
+	if format == "" {
+		format = "VDI"
+	}
+	md := &medium{location: location, uuid: v.nextUUID(), kind: "hdd", format: format, size: size}
+	v.media = append(v.media, md)
+	return fmt.Sprintf("0%%...10%%...20%%...30%%...40%%...50%%...60%%...70%%...80%%...90%%...100%%\nMedium created. UUID: %s\n", md.uuid), nil
+}
+
+func (v *VBoxManage) clonemedium(args []string) (string, error) {
+	pos, opts := parse(args)
+	if len(pos) > 0 && (pos[0] == "disk" || pos[0] == "dvd" || pos[0] == "floppy") {
+		pos = pos[1:]
+	}
+	if len(pos) != 2 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	source, out, err := v.openMedium("hdd", pos[0])
+	if err != nil {
+		return out, err
+	}
+	if fileExists(pos[1]) {
+		return fail("VBOX_E_FILE_ERROR", "MediumWrap", "IMedium", "CloneTo(pDstMedium, ...)",
+			"Cannot create the clone medium '%s' (VERR_ALREADY_EXISTS)", pos[1])
+	}
+	if err := copyFile(source.root().location, pos[1]); err != nil {
+		return fail("VBOX_E_FILE_ERROR", "MediumWrap", "IMedium", "CloneTo(pDstMedium, ...)",
+			"Cannot create the clone medium '%s' (%v)", pos[1], err)
+	}
+	format := opts["--format"]
+	if format == "" {
+		format = source.format
+	}
+	target := &medium{location: pos[1], uuid: v.nextUUID(), kind: source.kind, format: format, size: source.size}
+	v.media = append(v.media, target)
+	return fmt.Sprintf("0%%...10%%...20%%...30%%...40%%...50%%...60%%...70%%...80%%...90%%...100%%\nClone medium created in format '%s'. UUID: %s\n", format, target.uuid), nil
+}
+
+// modifymedium only changes the type of a medium, which must not be attached.
+func (v *VBoxManage) modifymedium(args []string) (string, error) {
+	pos, opts := parse(args)
+	if len(pos) > 0 && (pos[0] == "disk" || pos[0] == "dvd" || pos[0] == "floppy") {
+		pos = pos[1:]
+	}
+	if len(pos) != 1 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	md, out, err := v.openMedium("hdd", pos[0])
+	if err != nil {
+		return out, err
+	}
+	if mtype, ok := opts["--type"]; ok {
+		if users := v.usersOf(md); len(users) > 0 {
+			return fail("VBOX_E_OBJECT_IN_USE", "MediumWrap", "IMedium", "COMSETTER(Type)(enmMediumType)",
+				"Cannot change the type of medium '%s' because it is attached to %d virtual machines", md.location, len(users))
+		}
+		md.mtype = mtype
+	}
+	return "", nil
+}
+
+func copyFile(source string, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func (v *VBoxManage) closemedium(args []string) (string, error) {
+	pos, opts := parse(args)
+	kind := "hdd"
+	if len(pos) > 0 && (pos[0] == "disk" || pos[0] == "dvd" || pos[0] == "floppy") {
+		if pos[0] == "dvd" {
+			kind = "dvd"
+		}
+		pos = pos[1:]
+	}
+	if len(pos) == 0 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	md, out, err := v.openMedium(kind, pos[0])
+	if err != nil {
+		return out, err
+	}
+	if users := v.usersOf(md); len(users) > 0 {
+		return fail("VBOX_E_OBJECT_IN_USE", "MediumWrap", "IMedium", "Close()",
+			"Medium '%s' cannot be closed because it is still attached to 1 virtual machines", md.location)
+	}
+	for _, other := range v.media {
+		if other.parent == md {
+			return fail("VBOX_E_OBJECT_IN_USE", "MediumWrap", "IMedium", "Close()",
+				"Cannot close medium '%s' because it has 1 child media", md.location)
+		}
+	}
+	v.removeMedium(md)
+	if _, ok := opts["--delete"]; ok {
+		if err := os.Remove(md.location); err != nil {
+			return fail("VBOX_E_FILE_ERROR", "MediumWrap", "IMedium", "DeleteStorage(pProgress.asOutParam())",
+				"Could not delete the medium storage unit '%s' (%v)", md.location, err)
+		}
+	}
+	return "", nil
+}
+
+func (v *VBoxManage) findNatNetwork(name string) int {
+	for i, n := range v.natNetworks {
+		if n.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (v *VBoxManage) natnetwork(args []string) (string, error) {
+	if len(args) == 0 {
+		return syntaxError("Missing subcommand for 'natnetwork'")
+	}
+	_, opts := parse(args[1:])
+	name := opts["--netname"]
+	index := v.findNatNetwork(name)
+	if args[0] != "add" && index == -1 {
+		return fail("E_INVALIDARG", "VirtualBoxWrap", "IVirtualBox", "FindNATNetworkByName(Bstr(pszNetName).raw(), net.asOutParam())",
+			"Failed to find NAT network '%s'", name)
+	}
+	switch args[0] {
+	case "add":
+		if index != -1 {
+			return fail("E_INVALIDARG", "VirtualBoxWrap", "IVirtualBox", "CreateNATNetwork(NetName.raw(), net.asOutParam())",
+				"NATNetwork server already exists")
+		}
+		_, enabled := opts["--enable"]
+		v.natNetworks = append(v.natNetworks, &natNetwork{name: name, network: opts["--network"], enabled: enabled})
+	case "modify":
+		if _, ok := opts["--disable"]; ok {
+			v.natNetworks[index].enabled = false
+		}
+		if _, ok := opts["--enable"]; ok {
+			v.natNetworks[index].enabled = true
+		}
+	case "remove":
+		v.natNetworks = append(v.natNetworks[:index], v.natNetworks[index+1:]...)
+	default:
+		return syntaxError("Invalid parameter '%s'", args[0])
+	}
+	return "", nil
+}
+
+func (v *VBoxManage) dhcpserver(args []string) (string, error) {
+	if len(args) == 0 {
+		return syntaxError("Missing subcommand for 'dhcpserver'")
+	}
+	_, opts := parse(args[1:])
+	name := opts["--netname"]
+	index := -1
+	for i, d := range v.dhcpServers {
+		if d.netName == name {
+			index = i
+		}
+	}
+	switch args[0] {
+	case "add":
+		if index != -1 {
+			return fail("E_INVALIDARG", "VirtualBoxWrap", "IVirtualBox", "CreateDHCPServer(NetName.raw(), svr.asOutParam())",
+				"DHCP server already exists")
+		}
+		_, enabled := opts["--enable"]
+		v.dhcpServers = append(v.dhcpServers, &dhcpServer{netName: name, ip: opts["--ip"], mask: opts["--netmask"],
+			lower: opts["--lowerip"], upper: opts["--upperip"], enabled: enabled})
+	case "remove":
+		if index == -1 {
+			return fail("E_INVALIDARG", "VirtualBoxWrap", "IVirtualBox", "FindDHCPServerByNetworkName(NetName.raw(), svr.asOutParam())",
+				"DHCP server does not exist")
+		}
+		v.dhcpServers = append(v.dhcpServers[:index], v.dhcpServers[index+1:]...)
+	default:
+		return syntaxError("Invalid parameter '%s'", args[0])
+	}
+	return "", nil
+}
+
+// importOvf registers a machine named after --vmname, with the disks found beside the ovf file attached on a SATA controller.
+func (v *VBoxManage) importOvf(args []string) (string, error) {
+	pos, opts := parse(args)
+	if len(pos) == 0 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	if !fileExists(pos[0]) {
+		return fail("VBOX_E_FILE_ERROR", "ApplianceWrap", "IAppliance", "Read(Bstr(pszAbsFilePath).raw(), progressRead.asOutParam())",
+			"Could not find file '%s'", pos[0])
+	}
+	name := opts["--vmname"]
+	if v.findMachine(name) != nil {
+		return fail("VBOX_E_FILE_ERROR", "MachineWrap", "IMachine", "ImportMachines(...)", "Machine settings file already exists")
+	}
+	m := v.newMachine(name, "Other")
+	if err := os.MkdirAll(v.machineFolder(name), 0755); err != nil {
+		return fail("VBOX_E_FILE_ERROR", "MachineWrap", "IMachine", "SaveSettings()", "Could not create the directory '%s' (%v)", v.machineFolder(name), err)
+	}
+	c := &controller{name: "SATA", kind: "IntelAhci"}
+	m.controllers = append(m.controllers, c)
+	disks, _ := filepath.Glob(filepath.Join(filepath.Dir(pos[0]), "*.vmdk"))
+	for i, disk := range disks {
+		target := filepath.Join(v.machineFolder(name), filepath.Base(disk))
+		if err := copyFile(disk, target); err != nil {
+			return fail("VBOX_E_FILE_ERROR", "ApplianceWrap", "IAppliance", "ImportMachines(...)", "Could not copy '%s' (%v)", disk, err)
+		}
+		md := &medium{location: target, uuid: v.nextUUID(), kind: "hdd", format: "VMDK"}
+		v.media = append(v.media, md)
+		c.attachments = append(c.attachments, &attachment{port: i, medium: md})
+	}
+	v.machines = append(v.machines, m)
+	return "0%...10%...20%...30%...40%...50%...60%...70%...80%...90%...100%\nSuccessfully imported the appliance.\n", nil
+}
+
+// export writes an ova (a tar archive) containing an ovf descriptor and a copy of every attached hard disk.
+// Differencing disks are exported flattened, as VirtualBox does.
+func (v *VBoxManage) export(args []string) (string, error) {
+	pos, opts := parse(args)
+	if len(pos) == 0 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	m := v.findMachine(pos[0])
+	if m == nil {
+		return machineNotFound(pos[0])
+	}
+	if m.state == "running" || m.state == "paused" {
+		return machineLocked(m)
+	}
+	output := opts["--output"]
+	f, err := os.Create(output)
+	if err != nil {
+		return fail("VBOX_E_FILE_ERROR", "ApplianceWrap", "IAppliance", "Write(...)", "Could not create '%s' (%v)", output, err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	ovf := fmt.Sprintf("<?xml version=\"1.0\"?>\n<Envelope><VirtualSystem ovf:id=\"%s\"/></Envelope>\n", m.name)
+	entries := map[string]string{m.name + ".ovf": ""}
+	var names = []string{m.name + ".ovf"}
+	disk := 0
+	for _, md := range m.attachedMedia() {
+		if md.kind == "hdd" {
+			disk++
+			name := fmt.Sprintf("%s-disk%03d.vmdk", m.name, disk)
+			entries[name] = md.location
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		var content []byte
+		if entries[name] == "" {
+			content = []byte(ovf)
+		} else if content, err = os.ReadFile(v.findMedium(entries[name]).root().location); err != nil {
+			return fail("VBOX_E_FILE_ERROR", "ApplianceWrap", "IAppliance", "Write(...)", "Could not read '%s' (%v)", entries[name], err)
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			return fail("VBOX_E_FILE_ERROR", "ApplianceWrap", "IAppliance", "Write(...)", "Could not write '%s' (%v)", output, err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			return fail("VBOX_E_FILE_ERROR", "ApplianceWrap", "IAppliance", "Write(...)", "Could not write '%s' (%v)", output, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fail("VBOX_E_FILE_ERROR", "ApplianceWrap", "IAppliance", "Write(...)", "Could not write '%s' (%v)", output, err)
+	}
+	return "0%...10%...20%...30%...40%...50%...60%...70%...80%...90%...100%\nSuccessfully exported 1 machine(s).\n", nil
+}
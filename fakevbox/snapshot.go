@@ -0,0 +1,295 @@
+package fakevbox
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type snapshot struct {
+	name        string
+	uuid        string
+	description string
+	taken       time.Time
+	parent      *snapshot
+	children    []*snapshot
+	controllers []*controller // storage of the machine when the snapshot was taken
+	online      bool          // taken while running or paused: the machine is saved when restored
+}
+
+// walk visits the tree depth first, parents before children. s may be nil.
+func (s *snapshot) walk(f func(s *snapshot)) {
+	if s == nil {
+		return
+	}
+	f(s)
+	for _, child := range s.children {
+		child.walk(f)
+	}
+}
+
+func (s *snapshot) find(nameOrUUID string) (result *snapshot) {
+	s.walk(func(other *snapshot) {
+		if result == nil && (other.name == nameOrUUID || other.uuid == nameOrUUID) {
+			result = other
+		}
+	})
+	return
+}
+
+// write prints the tree as showvminfo --machinereadable: SnapshotName, then SnapshotName-1 for its first child...
+func (s *snapshot) write(w io.Writer, suffix string, current *snapshot) {
+	if s == nil {
+		return
+	}
+	fmt.Fprintf(w, "SnapshotName%s=%s\n", suffix, quote(s.name))
+	fmt.Fprintf(w, "SnapshotUUID%s=%s\n", suffix, quote(s.uuid))
+	fmt.Fprintf(w, "SnapshotDescription%s=%s\n", suffix, quote(s.description))
+	if s == current {
+		fmt.Fprintf(w, "CurrentSnapshotNode=%s\n", quote("SnapshotName"+suffix))
+	}
+	for i, child := range s.children {
+		child.write(w, fmt.Sprintf("%s-%d", suffix, i+1), current)
+	}
+}
+
+func copyControllers(controllers []*controller) (result []*controller) {
+	for _, c := range controllers {
+		cc := *c
+		cc.attachments = nil
+		for _, a := range c.attachments {
+			ca := *a
+			cc.attachments = append(cc.attachments, &ca)
+		}
+		result = append(result, &cc)
+	}
+	return
+}
+
+// differencing registers a new differencing disk of parent in folder, as VirtualBox does when a snapshot is taken
+// or a linked clone is created.
+func (v *VBoxManage) differencing(parent *medium, folder string) (*medium, error) {
+	md := &medium{uuid: v.nextUUID(), kind: "hdd", format: parent.format, size: parent.size, parent: parent}
+	md.location = filepath.Join(folder, "{"+md.uuid+"}."+strings.ToLower(parent.format))
+	if err := createFile(md.location); err != nil {
+		return nil, err
+	}
+	v.media = append(v.media, md)
+	return md, nil
+}
+
+func (v *VBoxManage) snapshot(args []string) (string, error) {
+	if len(args) < 2 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	m := v.findMachine(args[0])
+	if m == nil {
+		return machineNotFound(args[0])
+	}
+	pos, opts := parse(args[2:])
+	switch args[1] {
+	case "take":
+		if len(pos) == 0 {
+			return syntaxError("Missing snapshot name")
+		}
+		if m.state != "poweroff" && m.state != "aborted" && m.state != "saved" && m.state != "running" && m.state != "paused" {
+			return fail("VBOX_E_INVALID_VM_STATE", "SessionMachine", "IMachine", "TakeSnapshot(...)",
+				"Cannot take a snapshot of the machine while it is changing the state (machine state: %s)", m.state)
+		}
+		s := &snapshot{name: pos[0], uuid: v.nextUUID(), description: opts["--description"], taken: time.Now().UTC(),
+			parent: m.current, controllers: copyControllers(m.controllers), online: m.state == "running" || m.state == "paused"}
+		folder := filepath.Join(v.machineFolder(m.name), "Snapshots")
+		for _, c := range m.controllers {
+			for _, a := range c.attachments {
+				if a.medium.kind != "hdd" || a.medium.mtype == "writethrough" {
+					continue
+				}
+				md, err := v.differencing(a.medium, folder)
+				if err != nil {
+					return fail("VBOX_E_FILE_ERROR", "SessionMachine", "IMachine", "TakeSnapshot(...)", "Could not create the differencing medium (%v)", err)
+				}
+				a.medium = md
+			}
+		}
+		if m.current == nil {
+			m.snapshots = s
+		} else {
+			m.current.children = append(m.current.children, s)
+		}
+		m.current = s
+		return fmt.Sprintf("0%%...10%%...20%%...30%%...40%%...50%%...60%%...70%%...80%%...90%%...100%%\nSnapshot taken. UUID: %s\n", s.uuid), nil
+	case "restore", "delete":
+		if len(pos) == 0 {
+			return syntaxError("Missing snapshot name")
+		}
+		s := m.snapshots.find(pos[0])
+		if s == nil {
+			return fail("VBOX_E_OBJECT_NOT_FOUND", "MachineWrap", "IMachine", "FindSnapshot(Bstr(pszSnapshot).raw(), pSnapshot.asOutParam())",
+				"Could not find a snapshot named '%s'", pos[0])
+		}
+		if args[1] == "delete" {
+			return v.deleteSnapshot(m, s)
+		}
+		return v.restoreSnapshot(m, s)
+	case "list":
+		if m.snapshots == nil {
+			return "This machine does not have any snapshots\n", nil
+		}
+		w := &strings.Builder{}
+		m.snapshots.write(w, "", m.current)
+		return w.String(), nil
+	}
+	return syntaxError("Invalid parameter '%s'", args[1])
+}
+
+// clonevm supports full clones and linked clones (--options link) of a snapshot.
+func (v *VBoxManage) clonevm(args []string) (string, error) {
+	pos, opts := parse(args)
+	if len(pos) == 0 {
+		return syntaxError("VM name required")
+	}
+	source := v.findMachine(pos[0])
+	if source == nil {
+		return machineNotFound(pos[0])
+	}
+	name := opts["--name"]
+	if name == "" {
+		name = source.name + " Clone"
+	}
+	if v.findMachine(name) != nil || fileExists(v.machineFolder(name)) {
+		return fail("VBOX_E_FILE_ERROR", "MachineWrap", "IMachine", "CloneTo(...)", "Machine settings file '%s' already exists",
+			filepath.Join(v.machineFolder(name), name+".vbox"))
+	}
+	link := false
+	for _, option := range strings.Split(opts["--options"], ",") {
+		link = link || strings.EqualFold(option, "link")
+	}
+	controllers := source.controllers
+	if snapshotName, ok := opts["--snapshot"]; ok {
+		s := source.snapshots.find(snapshotName)
+		if s == nil {
+			return fail("VBOX_E_OBJECT_NOT_FOUND", "MachineWrap", "IMachine", "FindSnapshot(Bstr(pszSnapshot).raw(), pSnapshot.asOutParam())",
+				"Could not find a snapshot named '%s'", snapshotName)
+		}
+		controllers = s.controllers
+	} else if link {
+		return fail("E_INVALIDARG", "MachineWrap", "IMachine", "CloneTo(...)", "Linked clone can only be created from a snapshot")
+	}
+	m := v.newMachine(name, source.osType)
+	m.memory, m.cpus = source.memory, source.cpus
+	for k, value := range source.settings {
+		m.settings[k] = value
+	}
+	for k, value := range source.extraData {
+		m.extraData[k] = value
+	}
+	for index, n := range source.nics {
+		cn := *n
+		cn.rules = append([]natRule(nil), n.rules...)
+		cn.mac = m.nic(index).mac
+		m.nics[index] = &cn
+	}
+	folder := v.machineFolder(name)
+	m.controllers = copyControllers(controllers)
+	disk := 0
+	for _, c := range m.controllers {
+		for _, a := range c.attachments {
+			if a.medium.kind != "hdd" {
+				continue
+			}
+			if link {
+				md, err := v.differencing(a.medium, filepath.Join(folder, "Snapshots"))
+				if err != nil {
+					return fail("VBOX_E_FILE_ERROR", "MachineWrap", "IMachine", "CloneTo(...)", "Could not create the differencing medium (%v)", err)
+				}
+				a.medium = md
+				continue
+			}
+			disk++
+			md := &medium{uuid: v.nextUUID(), kind: "hdd", format: a.medium.format, size: a.medium.size,
+				location: filepath.Join(folder, fmt.Sprintf("%s-disk%d.%s", name, disk, strings.ToLower(a.medium.format)))}
+			if err := copyFile(a.medium.root().location, md.location); err != nil {
+				return fail("VBOX_E_FILE_ERROR", "MachineWrap", "IMachine", "CloneTo(...)", "Could not copy the medium '%s' (%v)", a.medium.location, err)
+			}
+			v.media = append(v.media, md)
+			a.medium = md
+		}
+	}
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return fail("VBOX_E_FILE_ERROR", "MachineWrap", "IMachine", "SaveSettings()", "Could not create the directory '%s' (%v)", folder, err)
+	}
+	if _, ok := opts["--register"]; ok {
+		v.machines = append(v.machines, m)
+	}
+	return fmt.Sprintf("0%%...10%%...20%%...30%%...40%%...50%%...60%%...70%%...80%%...90%%...100%%\nMachine has been successfully cloned as \"%s\"\n", name), nil
+}
+
+// restoreSnapshot puts back the storage of the snapshot, on new differencing disks. Those of the current state are deleted.
+func (v *VBoxManage) restoreSnapshot(m *machine, s *snapshot) (string, error) {
+	if m.state == "running" || m.state == "paused" {
+		return fail("VBOX_E_INVALID_VM_STATE", "SessionMachine", "IMachine", "RestoreSnapshot(pSnapshot, pProgress.asOutParam())",
+			"Cannot restore the snapshot while the machine is running")
+	}
+	folder := filepath.Join(v.machineFolder(m.name), "Snapshots")
+	controllers := copyControllers(s.controllers)
+	for _, c := range controllers {
+		for _, a := range c.attachments {
+			if a.medium.kind != "hdd" || a.medium.mtype == "writethrough" {
+				continue
+			}
+			md, err := v.differencing(a.medium, folder)
+			if err != nil {
+				return fail("VBOX_E_FILE_ERROR", "SessionMachine", "IMachine", "RestoreSnapshot(...)", "Could not create the differencing medium (%v)", err)
+			}
+			a.medium = md
+		}
+	}
+	for _, md := range m.attachedMedia() {
+		if md.kind == "hdd" && md.parent != nil && len(v.usersOf(md)) == 1 {
+			v.removeMedium(md)
+			_ = os.Remove(md.location)
+		}
+	}
+	m.controllers = controllers
+	m.current = s
+	if s.online {
+		m.setState("saved")
+	} else {
+		m.setState("poweroff")
+	}
+	return "0%...10%...20%...30%...40%...50%...60%...70%...80%...90%...100%\nRestoring snapshot '" + s.name + "' (" + s.uuid + ")\n", nil
+}
+
+// deleteSnapshot removes the snapshot from the tree. Data is kept in base media by this fake, so nothing is merged.
+func (v *VBoxManage) deleteSnapshot(m *machine, s *snapshot) (string, error) {
+	if len(s.children) > 1 {
+		return fail("VBOX_E_INVALID_OBJECT_STATE", "SessionMachine", "IMachine", "DeleteSnapshot(...)",
+			"Snapshot '%s' of the machine '%s' has more than one child snapshot (%d)", s.name, m.name, len(s.children))
+	}
+	if s.parent == nil {
+		m.snapshots = nil
+		if len(s.children) == 1 {
+			m.snapshots = s.children[0]
+			s.children[0].parent = nil
+		}
+	} else {
+		var children []*snapshot
+		for _, child := range s.parent.children {
+			if child != s {
+				children = append(children, child)
+			}
+		}
+		for _, child := range s.children {
+			child.parent = s.parent
+			children = append(children, child)
+		}
+		s.parent.children = children
+	}
+	if m.current == s {
+		m.current = s.parent
+	}
+	return "0%...10%...20%...30%...40%...50%...60%...70%...80%...90%...100%\n", nil
+}
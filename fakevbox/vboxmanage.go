@@ -0,0 +1,328 @@
+// Package fakevbox simulates VBoxManage in memory.
+// It keeps machines, media, NAT networks and DHCP servers, and answers commands with the output
+// (and error messages) a real VBoxManage would print, so that the virtualbox provider can run without VirtualBox:
+//
+//	virtualbox.SetRunner(fakevbox.New(machineFolder))
+package fakevbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ExitError is returned when a simulated command fails.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+type VBoxManage struct {
+	// Version is what VBoxManage --version answers.
+	Version string
+	// MachineFolder is the "Default machine folder" system property. Machine folders are created in it.
+	MachineFolder string
+
+	mu          sync.Mutex
+	machines    []*machine
+	media       []*medium
+	natNetworks []*natNetwork
+	dhcpServers []*dhcpServer
+	extraData   map[string]string
+	sequence    int
+	history     [][]string
+}
+
+func New(machineFolder string) *VBoxManage {
+	return &VBoxManage{
+		Version:       "7.0.20r163906",
+		MachineFolder: machineFolder,
+		extraData:     map[string]string{},
+	}
+}
+
+type handler func(v *VBoxManage, args []string) (string, error)
+
+var handlers = map[string]handler{
+	"list":          (*VBoxManage).list,
+	"createvm":      (*VBoxManage).createvm,
+	"unregistervm":  (*VBoxManage).unregistervm,
+	"showvminfo":    (*VBoxManage).showvminfo,
+	"modifyvm":      (*VBoxManage).modifyvm,
+	"storagectl":    (*VBoxManage).storagectl,
+	"storageattach": (*VBoxManage).storageattach,
+	"sharedfolder":  (*VBoxManage).sharedfolder,
+	"setextradata":  (*VBoxManage).setextradata,
+	"getextradata":  (*VBoxManage).getextradata,
+	"startvm":       (*VBoxManage).startvm,
+	"controlvm":     (*VBoxManage).controlvm,
+	"discardstate":  (*VBoxManage).discardstate,
+	"guestproperty": (*VBoxManage).guestproperty,
+	"createmedium":  (*VBoxManage).createmedium,
+	"clonemedium":   (*VBoxManage).clonemedium,
+	"closemedium":   (*VBoxManage).closemedium,
+	"modifymedium":  (*VBoxManage).modifymedium,
+	"natnetwork":    (*VBoxManage).natnetwork,
+	"dhcpserver":    (*VBoxManage).dhcpserver,
+	"import":        (*VBoxManage).importOvf,
+	"export":        (*VBoxManage).export,
+	"snapshot":      (*VBoxManage).snapshot,
+	"clonevm":       (*VBoxManage).clonevm,
+}
+
+// Run implements virtualbox.Runner.
+func (v *VBoxManage) Run(ctx context.Context, args ...string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.history = append(v.history, append([]string(nil), args...))
+	if len(args) == 0 {
+		return syntaxError("no command given")
+	}
+	if args[0] == "--version" || args[0] == "-v" {
+		return v.Version + "\n", nil
+	}
+	h, ok := handlers[strings.ToLower(args[0])]
+	if !ok {
+		return syntaxError("Invalid command '%s'", args[0])
+	}
+	return h(v, args[1:])
+}
+
+// History returns every command received so far, in order.
+func (v *VBoxManage) History() [][]string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([][]string(nil), v.history...)
+}
+
+// State returns the VMState of a registered machine, or "" if there is none with this name.
+func (v *VBoxManage) State(nameOrUUID string) string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if m := v.findMachine(nameOrUUID); m != nil {
+		return m.state
+	}
+	return ""
+}
+
+// SetState forces the state of a machine, to simulate a crash or a guest shutdown for example.
+func (v *VBoxManage) SetState(nameOrUUID string, state string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if m := v.findMachine(nameOrUUID); m != nil {
+		m.setState(state)
+	}
+}
+
+// Lock makes the next times commands changing the machine fail as if another session (the VirtualBox GUI for example) held its lock.
+func (v *VBoxManage) Lock(nameOrUUID string, times int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if m := v.findMachine(nameOrUUID); m != nil {
+		m.lockedFor = times
+	}
+}
+
+// SetGuestProperty simulates a property published by the guest additions (an IP address for example).
+func (v *VBoxManage) SetGuestProperty(nameOrUUID string, key string, value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if m := v.findMachine(nameOrUUID); m != nil {
+		m.guestProperties[key] = value
+	}
+}
+
+func (v *VBoxManage) nextUUID() string {
+	v.sequence++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012x", v.sequence)
+}
+
+var resultCodes = map[string]string{
+	"E_FAIL":                      "0x80004005",
+	"E_INVALIDARG":                "0x80070057",
+	"VBOX_E_OBJECT_NOT_FOUND":     "0x80bb0001",
+	"VBOX_E_INVALID_VM_STATE":     "0x80bb0002",
+	"VBOX_E_FILE_ERROR":           "0x80bb0004",
+	"VBOX_E_INVALID_OBJECT_STATE": "0x80bb0007",
+	"VBOX_E_OBJECT_IN_USE":        "0x80bb000c",
+}
+
+// fail mimics the three lines printed by VBoxManage when an API call fails.
+func fail(code string, component string, iface string, context string, format string, a ...interface{}) (string, error) {
+	lines := []string{
+		"VBoxManage: error: " + fmt.Sprintf(format, a...),
+		fmt.Sprintf("VBoxManage: error: Details: code %s (%s), component %s, interface %s, callee nsISupports", code, resultCodes[code], component, iface),
+		fmt.Sprintf("VBoxManage: error: Context: \"%s\" at line 1 of file VBoxManageFake.cpp", context),
+	}
+	return strings.Join(lines, "\n") + "\n", &ExitError{Code: 1}
+}
+
+func syntaxError(format string, a ...interface{}) (string, error) {
+	return "VBoxManage: error: " + fmt.Sprintf(format, a...) + "\n", &ExitError{Code: 2}
+}
+
+func machineNotFound(name string) (string, error) {
+	return fail("VBOX_E_OBJECT_NOT_FOUND", "VirtualBoxWrap", "IVirtualBox", "FindMachine(Bstr(VMNameOrUuid).raw(), machine.asOutParam())",
+		"Could not find a registered machine named '%s'", name)
+}
+
+func machineLocked(m *machine) (string, error) {
+	return fail("VBOX_E_INVALID_OBJECT_STATE", "MachineWrap", "IMachine", "LockMachine(a->session, LockType_Write)",
+		"The machine '%s' is already locked for a session (or being unlocked)", m.name)
+}
+
+func notMutable(m *machine) (string, error) {
+	return fail("VBOX_E_INVALID_VM_STATE", "SessionMachine", "IMachine", "LockMachine(a->session, LockType_Write)",
+		"The machine is not mutable (state is %s)", strings.ToUpper(m.state[:1])+m.state[1:])
+}
+
+var switches = map[string]bool{
+	"--register":        true,
+	"--delete":          true,
+	"--enable":          true,
+	"--disable":         true,
+	"--machinereadable": true,
+	"--transient":       true,
+	"--details":         true,
+	"--long":            true,
+	"--l":               true,
+}
+
+// parse separates positional arguments from options. Single dash options (-type) are normalised to double dash.
+func parse(args []string) (positional []string, options map[string]string) {
+	options = map[string]string{}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if !strings.HasPrefix(a, "-") {
+			positional = append(positional, a)
+			continue
+		}
+		name := "--" + strings.TrimLeft(a, "-")
+		if key, value, ok := strings.Cut(name, "="); ok {
+			options[key] = value
+			continue
+		}
+		if switches[name] || i+1 >= len(args) {
+			options[name] = ""
+			continue
+		}
+		options[name] = args[i+1]
+		i++
+	}
+	return
+}
+
+func (v *VBoxManage) list(args []string) (string, error) {
+	if len(args) == 0 {
+		return syntaxError("Missing subcommand for 'list'")
+	}
+	w := &strings.Builder{}
+	switch args[0] {
+	case "systemproperties":
+		fmt.Fprintf(w, "Default machine folder:          %s\n", v.MachineFolder)
+	case "vms":
+		for _, m := range v.machines {
+			fmt.Fprintf(w, "\"%s\" {%s}\n", m.name, m.uuid)
+		}
+	case "runningvms":
+		for _, m := range v.machines {
+			if m.state == "running" || m.state == "paused" {
+				fmt.Fprintf(w, "\"%s\" {%s}\n", m.name, m.uuid)
+			}
+		}
+	case "hdds", "dvds":
+		kind := strings.TrimSuffix(args[0], "s")
+		_, opts := parse(args[1:])
+		_, long := opts["--long"]
+		if _, l := opts["--l"]; l {
+			long = true
+		}
+		for _, md := range v.media {
+			if md.kind == kind {
+				v.writeMedium(w, md, long)
+				w.WriteString("\n")
+			}
+		}
+	case "natnets":
+		for _, n := range v.natNetworks {
+			n.write(w)
+			w.WriteString("\n")
+		}
+	case "dhcpservers":
+		for _, d := range v.dhcpServers {
+			d.write(w)
+			w.WriteString("\n")
+		}
+	default:
+		return syntaxError("Unknown subcommand '%s' for 'list'", args[0])
+	}
+	return w.String(), nil
+}
+
+func (v *VBoxManage) setextradata(args []string) (string, error) {
+	if len(args) < 2 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	data := v.extraData
+	if args[0] != "global" {
+		m := v.findMachine(args[0])
+		if m == nil {
+			return machineNotFound(args[0])
+		}
+		data = m.extraData
+	}
+	if len(args) < 3 || args[2] == "" {
+		delete(data, args[1])
+	} else {
+		data[args[1]] = args[2]
+	}
+	return "", nil
+}
+
+func (v *VBoxManage) getextradata(args []string) (string, error) {
+	if len(args) < 2 {
+		return syntaxError("Incorrect number of parameters")
+	}
+	data := v.extraData
+	if args[0] != "global" {
+		m := v.findMachine(args[0])
+		if m == nil {
+			return machineNotFound(args[0])
+		}
+		data = m.extraData
+	}
+	if args[1] == "enumerate" {
+		var keys []string
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w := &strings.Builder{}
+		for _, k := range keys {
+			fmt.Fprintf(w, "Key: %s, Value: %s\n", k, data[k])
+		}
+		return w.String(), nil
+	}
+	if value, ok := data[args[1]]; ok {
+		return fmt.Sprintf("Value: %s\n", value), nil
+	}
+	return "No value set!\n", nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -1,15 +1,19 @@
 package virtualbox
 
-import "github.com/iodasolutions/xbee-common/newfs"
+import (
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/newfs"
+)
 
 func virtualboxFd() newfs.Folder {
 	return newfs.GlobalXbeeFolder().ChildFolder("virtualbox")
 }
 
-func VolumesFolder() newfs.Folder {
-	return virtualboxFd().ChildFolder("volumes")
+// VolumesFolder and ExportFolder are folders of the hypervisor, since VBoxManage reads disks from there.
+func VolumesFolder() (newfs.Folder, *cmd.XbeeError) {
+	return hypervisorFolder(virtualboxFd().ChildFolder("volumes"))
 }
 
-func ExportFolder() newfs.Folder {
-	return virtualboxFd().ChildFolder("exports")
+func ExportFolder() (newfs.Folder, *cmd.XbeeError) {
+	return hypervisorFolder(virtualboxFd().ChildFolder("exports"))
 }
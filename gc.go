@@ -0,0 +1,383 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/iodasolutions/virtualbox/properties"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/newfs"
+	"github.com/iodasolutions/xbee-common/provider"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type OrphanKind string
+
+const (
+	OrphanVm       OrphanKind = "vm"
+	OrphanDisk     OrphanKind = "system disk"
+	OrphanSeedIso  OrphanKind = "seed iso"
+	OrphanVmFolder OrphanKind = "vm folder"
+	OrphanNetwork  OrphanKind = "network"
+	OrphanExport   OrphanKind = "export"
+	OrphanBaseVm   OrphanKind = "base vm"
+)
+
+// Orphan is something left behind by an interrupted Up or Delete.
+type Orphan struct {
+	Kind   OrphanKind
+	Name   string // vm, file or network name
+	Reason string
+	remove func(ctx context.Context) *cmd.XbeeError
+}
+
+func (o *Orphan) String() string {
+	return fmt.Sprintf("%-12s %s (%s)", o.Kind, o.Name, o.Reason)
+}
+
+func (o *Orphan) Remove(ctx context.Context) *cmd.XbeeError {
+	return o.remove(ctx)
+}
+
+// FindOrphans looks for leftovers of xbee in VirtualBox and on the hypervisor:
+//   - VMs of the current environment whose host is no more declared, and VMs of environments listed in gone
+//   - system disks and seed isos registered in VirtualBox but attached to no VM
+//   - folders of the machine folder holding a system disk or a seed iso, for no registered VM
+//   - default_<envId> networks of environments in gone, or of other environments without VM
+//   - ova exports of xbee VMs left in TmpDir
+//   - base VMs of linked clones which no VM is linked to
+func FindOrphans(ctx context.Context, gone []string) (result []*Orphan, err *cmd.XbeeError) {
+	goneEnvs := map[string]bool{}
+	for _, envId := range gone {
+		goneEnvs[envId] = true
+	}
+	declared := map[string]bool{}
+	vmNames := map[string]bool{}
+	for _, h := range provider.Hosts() {
+		declared[h.Name] = true
+		vmNames[fmt.Sprintf("%s_%s", h.Name, provider.EnvId())] = true
+	}
+	inventory, err := ListXbeeVms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	liveEnvs := map[string]bool{provider.EnvId(): true}
+	for envId, vms := range inventory {
+		for _, vm := range vms {
+			vmNames[vm.Name] = true
+			switch {
+			case goneEnvs[envId]:
+				result = append(result, vmOrphan(vm, "environment is gone"))
+			case envId == provider.EnvId() && !declared[vm.Host]:
+				result = append(result, vmOrphan(vm, "host no more declared"))
+			default:
+				liveEnvs[envId] = true
+			}
+		}
+	}
+	media, err := mediaOrphans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result, media...)
+	folders, err := folderOrphans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result, folders...)
+	networks, err := networkOrphans(ctx, goneEnvs, liveEnvs)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result, networks...)
+	exports, err := exportOrphans(vmNames)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result, exports...)
+	bases, err := baseVmOrphans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, bases...), nil
+}
+
+func vmOrphan(vm *XbeeVm, reason string) *Orphan {
+	return &Orphan{
+		Kind:   OrphanVm,
+		Name:   vm.Name,
+		Reason: fmt.Sprintf("%s, environment %s, %s", reason, vm.EnvId, vm.State),
+		remove: func(ctx context.Context) *cmd.XbeeError {
+			vb := VboxFrom(vm.UUID)
+			state := MachineState(vm.Machine.State)
+			switch {
+			case state == MachineSaved || state == MachineAbortedSaved:
+				if err := vb.DiscardState(ctx); err != nil {
+					return err
+				}
+			case !state.Off():
+				if err := vb.PowerOff(ctx); err != nil {
+					return err
+				}
+			}
+			// volumes are kept, they are deleted with Admin.DestroyVolumes
+			if sata := vm.Machine.Controller("SATA"); sata != nil {
+				for _, a := range sata.Attachments {
+					if a.Port != 0 {
+						if err := vb.DetachMedium(ctx, a.Port); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			_, err := vb.execute(ctx, "unregistervm", vm.UUID, "--delete")
+			return err
+		},
+	}
+}
+
+func mediaOrphans(ctx context.Context) (result []*Orphan, err *cmd.XbeeError) {
+	hdds, err := ListHdds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, hdd := range hdds {
+		if hdd.InUseBy == "" && path.Base(strings.ReplaceAll(hdd.Location, `\`, "/")) == "xbee-system.vmdk" {
+			result = append(result, mediumOrphan(OrphanDisk, "disk", hdd.Location, hdd.State))
+		}
+	}
+	out, err := VboxFrom("").execute(ctx, "list", "dvds")
+	if err != nil {
+		return nil, err
+	}
+	for _, aMap := range (&Parser{content: out}).asList() {
+		location := aMap["Location"]
+		if aMap["In use by VMs"] == "" && path.Base(strings.ReplaceAll(location, `\`, "/")) == "seed.iso" {
+			result = append(result, mediumOrphan(OrphanSeedIso, "dvd", location, aMap["State"]))
+		}
+	}
+	return
+}
+
+func mediumOrphan(kind OrphanKind, mediumType string, location string, state string) *Orphan {
+	return &Orphan{
+		Kind:   kind,
+		Name:   location,
+		Reason: "registered, attached to no vm",
+		remove: func(ctx context.Context) *cmd.XbeeError {
+			args := []string{"closemedium", mediumType, location}
+			// the file of an inaccessible medium is already gone
+			if state != "inaccessible" {
+				args = append(args, "--delete")
+			}
+			_, err := VboxFrom("").execute(ctx, args...)
+			return err
+		},
+	}
+}
+
+// orphanFolderMinAge keeps folders of VMs being created out of orphans: their disk is written before they are
+// registered. A creation in progress for longer would be taken for an orphan.
+const orphanFolderMinAge = time.Hour
+
+// folderOrphans returns folders of the machine folder with an xbee disk or seed iso, but no registered VM, unless
+// modified within orphanFolderMinAge.
+func folderOrphans(ctx context.Context) (result []*Orphan, err *cmd.XbeeError) {
+	registered, err := ListRegisteredVms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, r := range registered {
+		names[r.Name] = true
+	}
+	hv := currentHypervisor()
+	folders, err := hv.Dirs(properties.MachineFolder().String())
+	if err != nil {
+		return nil, err
+	}
+	for _, folder := range folders {
+		name := path.Base(strings.ReplaceAll(folder, `\`, "/"))
+		if names[name] {
+			continue
+		}
+		if hv.Exists(newfs.NewFolder(folder).ChildFile("xbee-system.vmdk").String()) || hv.Exists(newfs.NewFolder(folder).ChildFile("seed.iso").String()) {
+			modified, err := hv.LastModified(folder)
+			if err != nil {
+				return nil, err
+			}
+			if time.Since(modified) < orphanFolderMinAge {
+				log2.Debugf("folder %s has no registered vm but was modified %v ago, it may be a vm being created", folder, time.Since(modified).Round(time.Second))
+				continue
+			}
+			folder := folder
+			result = append(result, &Orphan{
+				Kind:   OrphanVmFolder,
+				Name:   folder,
+				Reason: "no vm registered with this name",
+				remove: func(ctx context.Context) *cmd.XbeeError {
+					if DryRun() {
+						log2.Infof("[dry-run] would delete folder %s", folder)
+						return nil
+					}
+					return hv.RemoveAll(folder)
+				},
+			})
+		}
+	}
+	return
+}
+
+func networkOrphans(ctx context.Context, goneEnvs map[string]bool, liveEnvs map[string]bool) (result []*Orphan, err *cmd.XbeeError) {
+	natnets, err := listNatNetworks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dhcps, err := NewDhcpServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, name := range natnets {
+		names[name] = true
+	}
+	for name := range dhcps.byName {
+		names[name] = true
+	}
+	for name := range names {
+		envId, ok := strings.CutPrefix(name, "default_")
+		if !ok || (!goneEnvs[envId] && liveEnvs[envId]) {
+			continue
+		}
+		name := name
+		reason := "no vm in environment " + envId
+		if goneEnvs[envId] {
+			reason = "environment is gone"
+		}
+		result = append(result, &Orphan{
+			Kind:   OrphanNetwork,
+			Name:   name,
+			Reason: reason,
+			remove: func(ctx context.Context) *cmd.XbeeError {
+				vb := VboxFrom("")
+				if dhcps.HasName(name) {
+					if err := vb.removeDhcpServer(ctx, name); err != nil {
+						return err
+					}
+				}
+				for _, natnet := range natnets {
+					if natnet == name {
+						return vb.remoteIntNet(ctx, name)
+					}
+				}
+				return nil
+			},
+		})
+	}
+	return
+}
+
+// listNatNetworks returns names of NAT networks. VirtualBox 7 prints them as Name, older versions as NetworkName.
+func listNatNetworks(ctx context.Context) (result []string, err *cmd.XbeeError) {
+	out, err := VboxFrom("").execute(ctx, "list", "natnets")
+	if err != nil {
+		return nil, err
+	}
+	for _, aMap := range (&Parser{content: out}).asList() {
+		if name := firstOf(aMap, "Name", "NetworkName"); name != "" {
+			result = append(result, name)
+		}
+	}
+	return
+}
+
+// exportOrphans looks for what Vbox.export leaves in TmpDir for vmNames: <vm name>.ova and its extraction folder
+// <vm name>. Other files of TmpDir are not xbee's. Exports of VMs which no longer exist are not found.
+func exportOrphans(vmNames map[string]bool) (result []*Orphan, err *cmd.XbeeError) {
+	hv := currentHypervisor()
+	tmp := newfs.TmpDir()
+	var names []string
+	for name := range vmNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ovas []string
+	for _, name := range names {
+		if ova := tmp.ChildFile(name + ".ova").String(); hv.Exists(ova) {
+			ovas = append(ovas, ova)
+		}
+		dir := tmp.ChildFolder(name).String()
+		if ovfs, err := hv.FilesEndingWith(dir, ".ovf"); err == nil && len(ovfs) > 0 {
+			ovas = append(ovas, dir)
+		}
+	}
+	for _, p := range ovas {
+		p := p
+		result = append(result, &Orphan{
+			Kind:   OrphanExport,
+			Name:   p,
+			Reason: "left by an interrupted image export",
+			remove: func(ctx context.Context) *cmd.XbeeError {
+				if DryRun() {
+					log2.Infof("[dry-run] would delete %s", p)
+					return nil
+				}
+				return hv.RemoveAll(p)
+			},
+		})
+	}
+	return
+}
+
+func baseVmOrphans(ctx context.Context) (result []*Orphan, err *cmd.XbeeError) {
+	registered, err := ListRegisteredVms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hdds, err := ListHdds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parents := map[string]string{}
+	children := map[string]int{}
+	for _, hdd := range hdds {
+		parents[hdd.UUID] = hdd.Parent
+		if hdd.Parent != "" {
+			children[hdd.Parent]++
+		}
+	}
+	for _, r := range registered {
+		extra, err := VboxFrom(r.UUID).ExtraData(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if extra[tagBase] == "" {
+			continue
+		}
+		machine, vErr := ShowMachineInfo(ctx, r.UUID)
+		if vErr != nil {
+			return nil, vErr.XbeeError()
+		}
+		// the base VM runs on a differencing disk of the base disk since its snapshot was taken, clones add others
+		reason := "no vm linked to it"
+		if current := machine.Controller("SATA").Attachment(0, 0); current == nil || parents[current.UUID] == "" {
+			reason = "creation was interrupted"
+		} else if children[parents[current.UUID]] > 1 {
+			continue
+		}
+		uuid := r.UUID
+		result = append(result, &Orphan{
+			Kind:   OrphanBaseVm,
+			Name:   r.Name,
+			Reason: reason,
+			remove: func(ctx context.Context) *cmd.XbeeError {
+				_, err := VboxFrom(uuid).execute(ctx, "unregistervm", uuid, "--delete")
+				return err
+			},
+		})
+	}
+	return
+}
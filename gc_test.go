@@ -0,0 +1,100 @@
+package virtualbox
+
+import (
+	"context"
+	"github.com/iodasolutions/virtualbox/properties"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func findOrphan(t *testing.T, ctx context.Context, gone []string, kind OrphanKind, name string) *Orphan {
+	t.Helper()
+	orphans, err := FindOrphans(ctx, gone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range orphans {
+		if o.Kind == kind && o.Name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+func TestVmOfGoneEnvironmentIsOrphan(t *testing.T) {
+	useFakeVbox(t)
+	ctx := context.Background()
+	vm := newTestVm(t, ctx, "a")
+	if err := vm.Vbox().SetExtraData(ctx, tagEnvId, "gone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VboxFrom("").execute(ctx, "natnetwork", "add", "--netname", "default_gone", "--network", "10.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	o := findOrphan(t, ctx, []string{"gone"}, OrphanVm, vm.Name())
+	if o == nil {
+		t.Fatalf("vm %s of a gone environment is not an orphan", vm.Name())
+	}
+	if err := o.Remove(ctx); err != nil {
+		t.Fatal(err)
+	}
+	registered, err := ListRegisteredVms(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registered) != 0 {
+		t.Errorf("vms still registered after removal : %v", registered)
+	}
+	if _, err := os.Stat(vm.VirtualDisk().String()); !os.IsNotExist(err) {
+		t.Errorf("system disk not deleted : %v", err)
+	}
+
+	o = findOrphan(t, ctx, []string{"gone"}, OrphanNetwork, "default_gone")
+	if o == nil {
+		t.Fatal("network of a gone environment is not an orphan")
+	}
+	if err := o.Remove(ctx); err != nil {
+		t.Fatal(err)
+	}
+	networks, err := listNatNetworks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 0 {
+		t.Errorf("networks left after removal : %v", networks)
+	}
+}
+
+func TestRecentFolderIsNotOrphan(t *testing.T) {
+	useFakeVbox(t)
+	ctx := context.Background()
+	folder := properties.MachineFolder().ChildFolder("ghost_x").String()
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	seed := filepath.Join(folder, "seed.iso")
+	if err := os.WriteFile(seed, []byte("seed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if o := findOrphan(t, ctx, nil, OrphanVmFolder, folder); o != nil {
+		t.Fatalf("folder %s of a vm maybe being created is an orphan", folder)
+	}
+	old := time.Now().Add(-2 * orphanFolderMinAge)
+	for _, p := range []string{seed, folder} {
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := findOrphan(t, ctx, nil, OrphanVmFolder, folder)
+	if o == nil {
+		t.Fatalf("folder %s is not an orphan", folder)
+	}
+	if err := o.Remove(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(folder); !os.IsNotExist(err) {
+		t.Errorf("folder %s not deleted : %v", folder, err)
+	}
+}
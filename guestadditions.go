@@ -4,11 +4,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"github.com/iodasolutions/virtualbox/properties"
 	"github.com/iodasolutions/xbee-common/cmd"
 	"github.com/iodasolutions/xbee-common/newfs"
 	"github.com/iodasolutions/xbee-common/template"
-	"os/exec"
+	"strings"
 	"unicode"
 )
 
@@ -46,9 +45,13 @@ fi
 `
 
 func EnsureGuestAdditions(ctx context.Context) (*newfs.File, *cmd.XbeeError) {
-	vboxVersion := Version()
+	vboxVersion, err := Version()
+	if err != nil {
+		return nil, err
+	}
 	url := fmt.Sprintf("https://download.virtualbox.org/virtualbox/%[1]s/VBoxGuestAdditions_%[1]s.iso", vboxVersion)
-	f, err := DownloadIfNotCached(ctx, url)
+	path, err := currentHypervisor().Download(ctx, url)
+	f := newfs.NewFile(path)
 	return &f, err
 }
 
@@ -57,14 +60,18 @@ func DetachGuestAdditions(ctx context.Context, vmName string) *cmd.XbeeError {
 	return vb.detachDvdStorage(ctx, "1")
 }
 
-func Version() string {
-	aCmd := exec.Command(properties.VboxPath(), "--version")
-	out, err := aCmd.Output()
+func Version() (string, *cmd.XbeeError) {
+	return versionFrom(currentRunner())
+}
+
+func versionFrom(r Runner) (string, *cmd.XbeeError) {
+	out, err := r.Run(context.Background(), "--version")
 	if err != nil {
-		panic(cmd.Error("unexpected error while running %s --version : %v", properties.VboxPath(), err))
+		return "", cmd.Error("unexpected error while running VBoxManage --version : %v %s", err, strings.TrimSpace(out))
 	}
-	extendedVersion := string(out)
-	return extractVersion(extendedVersion)
+	// VBoxManage may print warnings (kernel module not loaded...) before the version
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	return extractVersion(strings.TrimSpace(lines[len(lines)-1])), nil
 }
 
 func extractVersion(s string) string {
@@ -73,16 +80,20 @@ func extractVersion(s string) string {
 			return s[0:i]
 		}
 	}
-	return ""
+	return s
 }
 
-func GuestAdditionScript() string {
+func GuestAdditionScript() (string, *cmd.XbeeError) {
+	version, err := Version()
+	if err != nil {
+		return "", err
+	}
 	model := map[string]interface{}{
-		"version": Version(),
+		"version": version,
 	}
 	w := &bytes.Buffer{}
 	if err := template.OutputWithTemplate(installAdditions, w, model, nil); err != nil {
 		panic(cmd.Error("failed to parse userData template : %v", err))
 	}
-	return w.String()
+	return w.String(), nil
 }
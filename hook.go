@@ -0,0 +1,148 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/ssh2"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Events of the lifecycle of a VM, at which hooks run.
+const (
+	HookPreCreate   = "pre-create"
+	HookPostCreate  = "post-create" // the VM is registered, not started
+	HookPreStart    = "pre-start"
+	HookPostStart   = "post-start" // the guest is ready: cloud-init finished and probes passed
+	HookPreStop     = "pre-stop"
+	HookPostStop    = "post-stop"
+	HookPreImage    = "pre-image"
+	HookPostImage   = "post-image"
+	HookPreDestroy  = "pre-destroy"
+	HookPostDestroy = "post-destroy"
+)
+
+var hookEvents = []string{HookPreCreate, HookPostCreate, HookPreStart, HookPostStart, HookPreStop, HookPostStop,
+	HookPreImage, HookPostImage, HookPreDestroy, HookPostDestroy}
+
+// Hook is a command declared by a host for an event. It runs with sh on the machine running xbee, or in the guest
+// over SSH. It gets XBEE_VM_NAME, XBEE_HOST_NAME, XBEE_SSH_PORT and XBEE_INTERNAL_IP in its environment, empty
+// when unknown. Guest hooks are skipped when the VM is not running.
+// A failing hook stops the operation, unless it is non fatal.
+type Hook struct {
+	Event    string `json:"event"`
+	Command  string `json:"command"`
+	Guest    bool   `json:"guest,omitempty"`
+	NonFatal bool   `json:"non-fatal,omitempty"`
+}
+
+func (h Hook) String() string {
+	where := "host"
+	if h.Guest {
+		where = "guest"
+	}
+	return fmt.Sprintf("%s %s hook [%s]", h.Event, where, h.Command)
+}
+
+func (h Hook) validate() *cmd.XbeeError {
+	if h.Command == "" {
+		return cmd.Error("%s : command is required", h)
+	}
+	for _, event := range hookEvents {
+		if h.Event == event {
+			return nil
+		}
+	}
+	return cmd.Error("%s : unknown event, expected one of %s", h, strings.Join(hookEvents, ", "))
+}
+
+// runHooks runs hooks of event in their declaration order.
+func (vm *Vm) runHooks(ctx context.Context, event string) *cmd.XbeeError {
+	var env []string
+	for _, h := range vm.Host.Specification.Hooks {
+		if h.Event != event {
+			continue
+		}
+		if DryRun() {
+			log2.Infof("[dry-run] %s : would run %s", vm.HostName, h)
+			continue
+		}
+		if env == nil {
+			env = vm.hookEnv(ctx)
+		}
+		log2.Infof("%s : run %s", vm.HostName, h)
+		out, err := vm.runHook(ctx, h, env)
+		if err == nil {
+			log2.Debugf("%s : %s", vm.HostName, out)
+			continue
+		}
+		err = cmd.Error("%s : %s failed : %v\n%s", vm.HostName, h, err, strings.TrimSpace(out))
+		if !h.NonFatal {
+			return err
+		}
+		log2.Warnf("%v", err)
+	}
+	return nil
+}
+
+func (vm *Vm) runHook(ctx context.Context, h Hook, env []string) (string, *cmd.XbeeError) {
+	if !h.Guest {
+		c := exec.CommandContext(ctx, "sh", "-c", h.Command)
+		c.Env = append(os.Environ(), env...)
+		out, err := c.CombinedOutput()
+		if err != nil {
+			return string(out), cmd.Error("%v", err)
+		}
+		return string(out), nil
+	}
+	conn, err := vm.guestConn()
+	if err != nil {
+		return "", err
+	}
+	if conn == nil {
+		log2.Warnf("%s : vm is %s, skip %s", vm.HostName, vm.info.MachineState(), h)
+		return "", nil
+	}
+	var exports []string
+	for _, e := range env {
+		name, value, _ := strings.Cut(e, "=")
+		exports = append(exports, name+"="+shellQuote(value))
+	}
+	return conn.RunCommandToOut(fmt.Sprintf("export %s; %s", strings.Join(exports, " "), h.Command))
+}
+
+// guestConn returns the SSH connection of Up, or opens one. It is nil when the VM is not running.
+func (vm *Vm) guestConn() (*ssh2.SSHClient, *cmd.XbeeError) {
+	if vm.conn != nil {
+		return vm.conn, nil
+	}
+	if vm.info.MachineState() != MachineRunning {
+		return nil, nil
+	}
+	conn, err := ssh2.Connect(currentHypervisor().Address(), vm.SSHPort(), vm.User)
+	if err != nil {
+		return nil, err
+	}
+	vm.conn = conn
+	return conn, nil
+}
+
+func (vm *Vm) hookEnv(ctx context.Context) []string {
+	var ip string
+	if vm.info.MachineState() == MachineRunning {
+		if out, err := vm.Vbox().GetProperty(ctx, "/VirtualBox/GuestInfo/Net/1/V4/IP"); err == nil {
+			if value := extraValueFrom(out); value != "No value set!" {
+				ip = value
+			}
+		}
+	}
+	return []string{
+		"XBEE_VM_NAME=" + vm.Name(),
+		"XBEE_HOST_NAME=" + vm.HostName,
+		"XBEE_SSH_PORT=" + vm.SSHPort(),
+		"XBEE_INTERNAL_IP=" + ip,
+	}
+}
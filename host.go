@@ -6,14 +6,31 @@ import (
 	"github.com/iodasolutions/xbee-common/newfs"
 	"github.com/iodasolutions/xbee-common/provider"
 	"github.com/iodasolutions/xbee-common/util"
+	"strings"
 )
 
 type VboxHostData struct {
-	Cpus      int    `json:"cpus,omitempty"`
-	Memory    int    `json:"memory,omitempty"`
-	Disk      string `json:"disk,omitempty"`
-	OsType    string `json:"ostype,omitempty"`
-	Bootstrap string `json:"cloud-init,omitempty"`
+	Cpus      int     `json:"cpus,omitempty"`
+	Memory    int     `json:"memory,omitempty"`
+	Disk      string  `json:"disk,omitempty"`
+	OsType    string  `json:"ostype,omitempty"`
+	Bootstrap string  `json:"cloud-init,omitempty"`
+	Probes    []Probe `json:"probes,omitempty"`
+	Hooks     []Hook  `json:"hooks,omitempty"`
+	StartType string  `json:"start-type,omitempty"` // headless by default, see StartTypes
+}
+
+// StartTypes are the values of start-type and XBEE_VBOX_START_TYPE. gui opens the window of the VM; separate starts it
+// headless, a window can be attached later without restarting it.
+var StartTypes = []string{"headless", "gui", "separate"}
+
+func validStartType(startType string) bool {
+	for _, t := range StartTypes {
+		if startType == t {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *VboxHostData) File() newfs.File {
@@ -38,32 +55,77 @@ func NewHost(host *provider.XbeeHost) (*Host, *cmd.XbeeError) {
 	result.Disk = mapData["disk"].(string)
 	result.OsType = mapData["ostype"].(string)
 	result.Bootstrap = mapData["cloud-init"].(string)
+	for _, p := range result.Probes {
+		if err := p.validate(); err != nil {
+			return nil, cmd.Error("host %s : %v", host.Name, err)
+		}
+	}
+	if result.StartType != "" && !validStartType(result.StartType) {
+		return nil, cmd.Error("host %s : invalid start-type %s, expected one of %s", host.Name, result.StartType, strings.Join(StartTypes, ", "))
+	}
+	for _, h := range result.Hooks {
+		if err := h.validate(); err != nil {
+			return nil, cmd.Error("host %s : %v", host.Name, err)
+		}
+	}
 	return &Host{XbeeHost: host, Specification: &result}, nil
 }
 
-func (h *Host) PackDisk() newfs.File {
+// exportDisk is the image of hash, in the export folder of the hypervisor.
+func exportDisk(hash string) (newfs.File, *cmd.XbeeError) {
+	folder, err := ExportFolder()
+	if err != nil {
+		return newfs.NewFile(""), err
+	}
+	return folder.ChildFile(hash + ".vmdk"), nil
+}
+
+func (h *Host) PackDisk() (newfs.File, *cmd.XbeeError) {
 	if h.PackOrigin != nil {
-		return ExportFolder().ChildFile(h.PackHash + ".vmdk")
+		return exportDisk(h.PackHash)
 	}
-	return newfs.NewFile("")
+	return newfs.NewFile(""), nil
 }
 
-func (h *Host) OriginDisk() newfs.File {
+func (h *Host) OriginDisk() (newfs.File, *cmd.XbeeError) {
 	if h.PackOrigin != nil {
-		result := ExportFolder().ChildFile(h.PackHash + ".vmdk")
-		if result.Exists() {
-			return result
+		result, err := exportDisk(h.PackHash)
+		if err != nil {
+			return result, err
+		}
+		if currentHypervisor().Exists(result.String()) {
+			return result, nil
 		}
 	}
 	return h.SystemDisk()
 }
-func (h *Host) SystemDisk() newfs.File {
-	return ExportFolder().ChildFile(h.SystemHash + ".vmdk")
+func (h *Host) SystemDisk() (newfs.File, *cmd.XbeeError) {
+	return exportDisk(h.SystemHash)
 }
 
-func (h *Host) TargetDiskForImage() newfs.File {
+func (h *Host) TargetDiskForImage() (newfs.File, *cmd.XbeeError) {
 	if h.PackOrigin != nil {
-		return ExportFolder().ChildFile(h.PackHash + ".vmdk")
+		return exportDisk(h.PackHash)
 	}
 	return h.SystemDisk()
 }
+
+// targetHashForImage is the hash of TargetDiskForImage.
+func (h *Host) targetHashForImage() string {
+	if h.PackOrigin != nil {
+		return h.PackHash
+	}
+	return h.SystemHash
+}
+
+// originHash is the hash of the origin disk of a new VM: the pack image when there is one, the system otherwise.
+func (h *Host) originHash(origin newfs.File) (string, *cmd.XbeeError) {
+	pack, err := h.PackDisk()
+	if err != nil {
+		return "", err
+	}
+	if h.PackOrigin != nil && origin.String() == pack.String() {
+		return h.PackHash, nil
+	}
+	return h.SystemHash, nil
+}
@@ -0,0 +1,228 @@
+package virtualbox
+
+import (
+	"context"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/newfs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// hypervisor is the machine VirtualBox runs on: the local one, or a Remote one when XBEE_VBOX_REMOTE is set.
+// Paths given to VBoxManage (disks, seed iso, shared folders) are paths on the hypervisor, so files they refer to
+// are checked, written and moved through it.
+type hypervisor interface {
+	// Address is where ports forwarded by NAT rules are reached.
+	Address() string
+	// NATHostIP is the host ip of NAT rules. Empty means every interface.
+	NATHostIP() string
+	// Path translates a path of the local xbee folder to the same file on the hypervisor.
+	Path(local string) (string, *cmd.XbeeError)
+	Exists(path string) bool
+	MkdirAll(path string) *cmd.XbeeError
+	WriteFile(path string, data []byte) *cmd.XbeeError
+	Rename(from string, to string) *cmd.XbeeError
+	RemoveAll(path string) *cmd.XbeeError
+	Untar(archive string, dir string) *cmd.XbeeError
+	FilesEndingWith(dir string, suffix string) ([]string, *cmd.XbeeError)
+	// Dirs returns sub folders of dir, none if dir does not exist.
+	Dirs(dir string) ([]string, *cmd.XbeeError)
+	// LastModified is the latest modification time of dir and of its direct children.
+	LastModified(dir string) (time.Time, *cmd.XbeeError)
+	// Tail returns the last lines of path, all of them when lines is 0, nothing if path does not exist.
+	Tail(path string, lines int) (string, *cmd.XbeeError)
+	// Upload copies files of the local folder which are missing or different on the hypervisor, and returns the
+	// folder there.
+	Upload(ctx context.Context, local string) (string, *cmd.XbeeError)
+	// Download puts rawUrl in the xbee cache of the hypervisor, unless already there, and returns the cached file.
+	Download(ctx context.Context, rawUrl string) (string, *cmd.XbeeError)
+	// ExtractVmdk returns the vmdk disk of a downloaded disk or vagrant box.
+	ExtractVmdk(path string) (string, *cmd.XbeeError)
+}
+
+func currentHypervisor() hypervisor {
+	var result hypervisor = localHypervisor{}
+	if remote, ok := currentRunner().(*Remote); ok {
+		result = remote
+	}
+	if DryRun() {
+		return dryHypervisor{result}
+	}
+	return result
+}
+
+// dryHypervisor prints changes of files instead of making them, as dryRunner does for VBoxManage commands.
+// Upload, Download and ExtractVmdk check DryRun themselves.
+type dryHypervisor struct {
+	hypervisor
+}
+
+func (dryHypervisor) MkdirAll(path string) *cmd.XbeeError {
+	log2.Infof("[dry-run] would create folder %s", path)
+	return nil
+}
+
+func (dryHypervisor) WriteFile(path string, data []byte) *cmd.XbeeError {
+	log2.Infof("[dry-run] would write %s (%d bytes)", path, len(data))
+	return nil
+}
+
+func (dryHypervisor) Rename(from string, to string) *cmd.XbeeError {
+	log2.Infof("[dry-run] would move %s to %s", from, to)
+	return nil
+}
+
+func (dryHypervisor) RemoveAll(path string) *cmd.XbeeError {
+	log2.Infof("[dry-run] would delete %s", path)
+	return nil
+}
+
+func (dryHypervisor) Untar(archive string, dir string) *cmd.XbeeError {
+	log2.Infof("[dry-run] would extract %s to %s", archive, dir)
+	return nil
+}
+
+// hypervisorFolder is the folder of the hypervisor matching a local xbee folder.
+func hypervisorFolder(local newfs.Folder) (newfs.Folder, *cmd.XbeeError) {
+	p, err := currentHypervisor().Path(local.String())
+	if err != nil {
+		return newfs.NewFolder(""), err
+	}
+	return newfs.NewFolder(p), nil
+}
+
+type localHypervisor struct{}
+
+func (localHypervisor) Address() string {
+	return "127.0.0.1"
+}
+
+func (localHypervisor) NATHostIP() string {
+	return "127.0.0.1"
+}
+
+func (localHypervisor) Path(local string) (string, *cmd.XbeeError) {
+	return local, nil
+}
+
+func (localHypervisor) Exists(path string) bool {
+	return newfs.NewFile(path).Exists()
+}
+
+func (localHypervisor) MkdirAll(path string) *cmd.XbeeError {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return cmd.Error("cannot create folder %s : %v", path, err)
+	}
+	return nil
+}
+
+func (localHypervisor) WriteFile(path string, data []byte) *cmd.XbeeError {
+	fd, err := newfs.NewFile(path).OpenFileForCreation()
+	if err != nil {
+		return cmd.Error("failed to open file: %s", err)
+	}
+	defer fd.Close()
+	if _, err := fd.Write(data); err != nil {
+		return cmd.Error("failed to write file %s : %v", path, err)
+	}
+	return nil
+}
+
+func (h localHypervisor) Rename(from string, to string) *cmd.XbeeError {
+	if err := h.MkdirAll(filepath.Dir(to)); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return cmd.Error("cannot rename %s to %s: %v", from, to, err)
+	}
+	return nil
+}
+
+func (localHypervisor) RemoveAll(path string) *cmd.XbeeError {
+	return newfs.NewFolder(path).Delete()
+}
+
+func (localHypervisor) Untar(archive string, dir string) *cmd.XbeeError {
+	return newfs.NewFile(archive).Untar(dir)
+}
+
+func (localHypervisor) FilesEndingWith(dir string, suffix string) ([]string, *cmd.XbeeError) {
+	var result []string
+	for _, f := range newfs.NewFolder(dir).ChildrenFilesEndingWith(suffix) {
+		result = append(result, f.String())
+	}
+	return result, nil
+}
+
+func (localHypervisor) Dirs(dir string) ([]string, *cmd.XbeeError) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, cmd.Error("cannot read folder %s : %v", dir, err)
+	}
+	var result []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			result = append(result, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return result, nil
+}
+
+func (localHypervisor) LastModified(dir string) (time.Time, *cmd.XbeeError) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, cmd.Error("cannot read folder %s : %v", dir, err)
+	}
+	result := info.ModTime()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, cmd.Error("cannot read folder %s : %v", dir, err)
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.ModTime().After(result) {
+			result = info.ModTime()
+		}
+	}
+	return result, nil
+}
+
+func (localHypervisor) Tail(path string, lines int) (string, *cmd.XbeeError) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", cmd.Error("cannot read file %s : %v", path, err)
+	}
+	content := string(data)
+	if all := strings.SplitAfter(content, "\n"); lines > 0 && len(all) > lines {
+		// the last element is empty when content ends with a new line
+		if all[len(all)-1] == "" {
+			all = all[:len(all)-1]
+		}
+		if len(all) > lines {
+			content = strings.Join(all[len(all)-lines:], "")
+		}
+	}
+	return content, nil
+}
+
+func (localHypervisor) Upload(ctx context.Context, local string) (string, *cmd.XbeeError) {
+	return local, nil
+}
+
+func (localHypervisor) Download(ctx context.Context, rawUrl string) (string, *cmd.XbeeError) {
+	f, err := DownloadIfNotCached(ctx, rawUrl)
+	return f.String(), err
+}
+
+func (localHypervisor) ExtractVmdk(path string) (string, *cmd.XbeeError) {
+	f, err := extractVmdk(newfs.NewFile(path))
+	return f.String(), err
+}
@@ -0,0 +1,174 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/provider"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Extradata keys set on every VM created by xbee, so that it can be found again without the configuration which created it.
+const (
+	tagEnvId      = "xbee/EnvId"
+	tagHost       = "xbee/Host"
+	tagSystemHash = "xbee/SystemHash"
+	tagPackHash   = "xbee/PackHash"
+	tagCreatedAt  = "xbee/CreatedAt"
+)
+
+func (vm *Vm) tag(ctx context.Context) *cmd.XbeeError {
+	tags := []Pair{
+		{Key: tagEnvId, Value: provider.EnvId()},
+		{Key: tagHost, Value: vm.HostName},
+		{Key: tagSystemHash, Value: vm.Host.SystemHash},
+		{Key: tagPackHash, Value: vm.Host.PackHash},
+		{Key: tagCreatedAt, Value: time.Now().UTC().Format(time.RFC3339)},
+	}
+	vb := vm.Vbox()
+	for _, t := range tags {
+		if t.Value == "" {
+			continue
+		}
+		if err := vb.SetExtraData(ctx, t.Key, t.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisteredVm is an entry of VBoxManage list vms.
+type RegisteredVm struct {
+	Name string
+	UUID string
+}
+
+var registeredVmRegexp = regexp.MustCompile(`^"(.*)" \{([0-9a-fA-F-]+)\}$`)
+
+// ListRegisteredVms returns every VM registered in VirtualBox, whoever created it.
+func ListRegisteredVms(ctx context.Context) (result []RegisteredVm, err *cmd.XbeeError) {
+	var out string
+	if out, err = VboxFrom("").execute(ctx, "list", "vms"); err != nil {
+		return
+	}
+	for _, line := range splitLines(out) {
+		if m := registeredVmRegexp.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			result = append(result, RegisteredVm{Name: m[1], UUID: m[2]})
+		}
+	}
+	return
+}
+
+// XbeeVm is a VM created by xbee, as found in VirtualBox.
+type XbeeVm struct {
+	Name       string
+	UUID       string
+	EnvId      string
+	Host       string
+	SystemHash string
+	PackHash   string
+	CreatedAt  time.Time
+	// Tagged is false for VMs created before extradata tags, recognized by their name and system disk.
+	Tagged    bool
+	State     string
+	Disks     []string // hard disks attached
+	DiskUsage int64    // bytes used on the hypervisor by hard disks attached
+	Machine   *MachineInfo
+}
+
+// Inventory holds xbee VMs registered in VirtualBox, by environment id.
+type Inventory map[string][]*XbeeVm
+
+func (inv Inventory) EnvIds() (result []string) {
+	for envId := range inv {
+		result = append(result, envId)
+	}
+	sort.Strings(result)
+	return
+}
+
+// ListXbeeVms finds VMs created by xbee for any environment, including those no more declared in a configuration.
+func ListXbeeVms(ctx context.Context) (Inventory, *cmd.XbeeError) {
+	registered, err := ListRegisteredVms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hdds, err := ListHdds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	for _, hdd := range hdds {
+		sizes[hdd.Location] = hdd.SizeOnDisk
+	}
+	result := Inventory{}
+	for _, r := range registered {
+		machine, vErr := ShowMachineInfo(ctx, r.UUID)
+		if vErr != nil {
+			if vErr.NotFound() {
+				continue
+			}
+			return nil, cmd.Error("cannot read configuration of vm %s (%s) : %s", r.Name, vErr.Kind, vErr.Message())
+		}
+		extra, err := VboxFrom(r.UUID).ExtraData(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if vm := xbeeVmFrom(r, machine, extra, sizes); vm != nil {
+			result[vm.EnvId] = append(result[vm.EnvId], vm)
+		}
+	}
+	for _, vms := range result {
+		sort.Slice(vms, func(i, j int) bool { return vms[i].Host < vms[j].Host })
+	}
+	return result, nil
+}
+
+// xbeeVmFrom returns nil when the VM was not created by xbee.
+func xbeeVmFrom(r RegisteredVm, machine *MachineInfo, extra map[string]string, sizes map[string]int64) *XbeeVm {
+	result := &XbeeVm{
+		Name:       r.Name,
+		UUID:       r.UUID,
+		EnvId:      extra[tagEnvId],
+		Host:       extra[tagHost],
+		SystemHash: extra[tagSystemHash],
+		PackHash:   extra[tagPackHash],
+		State:      MachineState(machine.State).ProviderState(),
+		Machine:    machine,
+	}
+	result.CreatedAt, _ = time.Parse(time.RFC3339, extra[tagCreatedAt])
+	result.Tagged = result.EnvId != ""
+	sata := machine.Controller("SATA")
+	if !result.Tagged {
+		system := sata.Attachment(0, 0)
+		index := strings.LastIndex(r.Name, "_")
+		if system == nil || path.Base(strings.ReplaceAll(system.Medium, `\`, "/")) != "xbee-system.vmdk" || index == -1 {
+			return nil
+		}
+		result.Host, result.EnvId = r.Name[:index], r.Name[index+1:]
+	}
+	if sata != nil {
+		for _, a := range sata.Attachments {
+			result.Disks = append(result.Disks, a.Medium)
+			result.DiskUsage += sizes[a.Medium]
+		}
+	}
+	return result
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
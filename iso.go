@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"github.com/iodasolutions/virtualbox/properties"
 	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
 	"github.com/iodasolutions/xbee-common/newfs"
 	"github.com/iodasolutions/xbee-common/provider"
 	"github.com/iodasolutions/xbee-common/template"
@@ -61,6 +62,17 @@ func (iso *Iso) authorizedKeyScript() string {
 }
 
 func (iso *Iso) CreateAndAttach(ctx context.Context) *cmd.XbeeError {
+	isoFile := iso.File()
+	if DryRun() {
+		log2.Infof("[dry-run] would write seed iso %s", isoFile)
+	} else if err := iso.write(); err != nil {
+		return err
+	}
+	vb := VboxFrom(iso.vm.Name())
+	return vb.attacheDvdStorage(ctx, isoFile, "0")
+}
+
+func (iso *Iso) write() *cmd.XbeeError {
 	aMap := map[string]interface{}{
 		"name":       iso.vm.HostName,
 		"authorized": base64.StdEncoding.EncodeToString([]byte(iso.authorizedKeyScript())),
@@ -85,18 +97,12 @@ func (iso *Iso) CreateAndAttach(ctx context.Context) *cmd.XbeeError {
 	if err3 := writer.AddFile(strings.NewReader(t2), "user-data"); err3 != nil {
 		panic(cmd.Error("failed to add file: %s", err3))
 	}
-	isoFile := iso.File()
-	fd, err := isoFile.OpenFileForCreation()
-	if err != nil {
-		return cmd.Error("failed to open file: %s", err)
-	}
-	defer fd.Close()
-
-	if err3 := writer.WriteTo(fd, "cidata"); err3 != nil {
-		panic(cmd.Error("failed to write ISO image: %s", err))
+	// the image is built in memory, the seed iso may be on a remote hypervisor
+	w := &bytes.Buffer{}
+	if err3 := writer.WriteTo(w, "cidata"); err3 != nil {
+		panic(cmd.Error("failed to write ISO image: %s", err3))
 	}
-	vb := VboxFrom(iso.vm.Name())
-	return vb.attacheDvdStorage(ctx, isoFile, "0")
+	return currentHypervisor().WriteFile(iso.File().String(), w.Bytes())
 }
 
 func (iso *Iso) DetachAndDelete(ctx context.Context) (err *cmd.XbeeError) {
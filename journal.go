@@ -0,0 +1,132 @@
+package virtualbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/provider"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DryRun is enabled with XBEE_VBOX_DRY_RUN. VBoxManage commands changing state, and changes of files on the
+// hypervisor, are printed instead of being run.
+func DryRun() bool {
+	return envBool(envDryRun)
+}
+
+// journalEnabled is enabled with XBEE_VBOX_JOURNAL. Every VBoxManage command run is appended to JournalFile.
+func journalEnabled() bool {
+	return envBool(envJournal)
+}
+
+func JournalFile() string {
+	name := provider.EnvId()
+	if name == "" {
+		name = "global"
+	}
+	return virtualboxFd().ChildFolder("journal").ChildFile(name + ".log").String()
+}
+
+// decorate wraps the runner according to dry-run and journal modes.
+func decorate(r Runner) Runner {
+	if journalEnabled() {
+		r = &journalRunner{next: r, path: JournalFile()}
+	}
+	if DryRun() {
+		r = &dryRunner{next: r}
+	}
+	return r
+}
+
+// readOnly tells whether a VBoxManage command only queries virtualbox.
+func readOnly(args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	switch args[0] {
+	case "--version", "list", "showvminfo", "showmediuminfo", "getextradata":
+		return true
+	case "guestproperty":
+		return len(args) > 1 && (args[1] == "get" || args[1] == "enumerate")
+	case "snapshot":
+		return len(args) > 2 && (args[2] == "list" || args[2] == "showvminfo")
+	}
+	return false
+}
+
+// commandLine quotes args the way a shell would need them, so that printed commands can be pasted.
+func commandLine(args []string) string {
+	return shellJoin(append([]string{"VBoxManage"}, args...))
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func shellQuote(arg string) string {
+	if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`*?;&|<>()[]{}~#!") {
+		return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return arg
+}
+
+type dryRunner struct {
+	next Runner
+}
+
+func (r *dryRunner) Run(ctx context.Context, args ...string) (string, error) {
+	if readOnly(args) {
+		return r.next.Run(ctx, args...)
+	}
+	log2.Infof("[dry-run] %s", commandLine(args))
+	return "", nil
+}
+
+var journalLock = &sync.Mutex{}
+
+type journalRunner struct {
+	next Runner
+	path string
+}
+
+func (r *journalRunner) Run(ctx context.Context, args ...string) (string, error) {
+	start := time.Now()
+	out, err := r.next.Run(ctx, args...)
+	status := "0"
+	if err != nil {
+		var exitErr interface{ ExitCode() int }
+		if errors.As(err, &exitErr) {
+			status = fmt.Sprintf("%d", exitErr.ExitCode())
+		} else {
+			status = err.Error()
+		}
+	}
+	line := fmt.Sprintf("%s\t%v\texit=%s\t%s\n", start.Format(time.RFC3339), time.Since(start).Round(time.Millisecond), status, commandLine(args))
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	if err2 := appendTo(r.path, line); err2 != nil {
+		log2.Warnf("cannot write journal %s : %v", r.path, err2)
+	}
+	return out, err
+}
+
+func appendTo(path string, line string) error {
+	if err := os.MkdirAll(path[:strings.LastIndexAny(path, `/\`)], 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(line)
+	return err
+}
@@ -0,0 +1,121 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/iodasolutions/virtualbox/properties"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"sync"
+	"time"
+)
+
+// With XBEE_VBOX_LINKED_CLONES set, VMs are not created with a full copy of their origin disk. A base VM holding the
+// origin disk is registered once per SystemHash or PackHash, with a snapshot, and VMs are linked clones of this
+// snapshot: they only store a differencing disk.
+const (
+	tagBase      = "xbee/Base" // hash of the origin disk of a base VM
+	baseSnapshot = "xbee-base"
+)
+
+func LinkedClones() bool {
+	return envBool(envLinkedClones)
+}
+
+func baseVmName(hash string) string {
+	return "xbee-base-" + hash
+}
+
+var baseVmLock = &sync.Mutex{}
+
+// ensureBaseVm registers the base VM of the origin disk of vm, unless already there, and returns its name.
+func (vm *Vm) ensureBaseVm(ctx context.Context) (string, *cmd.XbeeError) {
+	baseVmLock.Lock()
+	defer baseVmLock.Unlock()
+	hash, err := vm.Host.originHash(vm.originDisk)
+	if err != nil {
+		return "", err
+	}
+	name := baseVmName(hash)
+	vb := VboxFrom(name)
+	machine, vErr := ShowMachineInfo(ctx, name)
+	switch {
+	case vErr == nil && machine.Snapshot(baseSnapshot) != nil:
+		return name, nil
+	case vErr == nil:
+		log2.Warnf("base vm %s has no snapshot %s, its creation was interrupted : create it again", name, baseSnapshot)
+		if _, err := vb.execute(ctx, "unregistervm", name, "--delete"); err != nil {
+			return "", err
+		}
+	case !vErr.NotFound():
+		return "", vErr.XbeeError()
+	}
+	log2.Infof("Create base vm %s for linked clones of %s", name, vm.originDisk)
+	if _, err := vb.execute(ctx, "createvm", "--name", name, "--ostype", vm.Host.Specification.OsType, "--register"); err != nil {
+		return "", err
+	}
+	if err := vb.SetExtraData(ctx, tagBase, hash); err != nil {
+		return "", err
+	}
+	if _, err := vb.execute(ctx, "storagectl", name, "--name", "SATA", "--add", "sata"); err != nil {
+		return "", err
+	}
+	if _, err := vb.execute(ctx, "storagectl", name, "--name", "IDE", "--add", "IDE"); err != nil {
+		return "", err
+	}
+	disk := properties.VmFolder(name).ChildFile("xbee-base.vmdk")
+	if err := vb.cloneMedium(ctx, vm.originDisk, disk); err != nil {
+		return "", err
+	}
+	if err := vb.attachHddStorage(ctx, disk, "0"); err != nil {
+		return "", err
+	}
+	if _, err := vb.execute(ctx, "snapshot", name, "take", baseSnapshot); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// createLinkedClone creates the VM as a linked clone of the base VM of its origin disk. The clone has the storage
+// controllers and the system disk of the base VM.
+func (vm *Vm) createLinkedClone(ctx context.Context, tx *rollback) *cmd.XbeeError {
+	caps, err := vm.Vbox().caps()
+	if err != nil {
+		return err
+	}
+	if err := caps.Require(FeatureLinkedClone); err != nil {
+		return err
+	}
+	base, err := vm.ensureBaseVm(ctx)
+	if err != nil {
+		return err
+	}
+	log2.Infof("%s : Host does not exist, create it as a linked clone of %s", vm.HostName, base)
+	vb := vm.Vbox()
+	if _, err := vb.execute(ctx, "clonevm", base, "--snapshot", baseSnapshot, "--options", "link", "--name", vm.Name(), "--register"); err != nil {
+		return err
+	}
+	if machine, vErr := ShowMachineInfo(ctx, vm.Name()); vErr == nil {
+		if a := machine.Controller("SATA").Attachment(0, 0); a != nil {
+			tx.undoSystemDisk(a.Medium)
+		}
+	}
+	tx.undoRegistration()
+	// extradata are cloned too, the clone is not a base VM
+	return vb.SetExtraData(ctx, tagBase, "")
+}
+
+// retireBaseVm renames the base VM of hash, so that VMs created from now are linked to a new image of the same hash.
+// VMs already linked to it keep working; it is removed by the garbage collector once they are destroyed.
+func retireBaseVm(ctx context.Context, hash string) *cmd.XbeeError {
+	name := baseVmName(hash)
+	if _, vErr := ShowMachineInfo(ctx, name); vErr != nil {
+		if vErr.NotFound() {
+			return nil
+		}
+		return vErr.XbeeError()
+	}
+	retired := fmt.Sprintf("%s-%d", name, time.Now().Unix())
+	log2.Infof("base vm %s is renamed %s : its disk is replaced by a new image", name, retired)
+	return VboxFrom(name).Modify(ctx, "--name", retired)
+}
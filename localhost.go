@@ -17,7 +17,7 @@ type nextPort struct {
 }
 
 func (np *nextPort) isPortAvailable(port int) bool {
-	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	conn, err := net.Dial("tcp", net.JoinHostPort(currentHypervisor().Address(), strconv.Itoa(port)))
 	if err != nil {
 		return true
 	}
@@ -0,0 +1,350 @@
+package virtualbox
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MachineInfo is the configuration of a registered VM, parsed from VBoxManage showvminfo <vm> --machinereadable.
+type MachineInfo struct {
+	Name            string
+	UUID            string
+	OSType          string
+	Groups          []string
+	CfgFile         string
+	State           string // VMState as printed by VBoxManage: running, poweroff, saved...
+	StateChangeTime string
+	Memory          int // MB
+	CPUs            int
+	Firmware        string // BIOS or EFI
+	NICs            []NIC  // enabled adapters only, by increasing index
+	Controllers     []StorageController
+	SharedFolders   []SharedFolder
+	Snapshots       []Snapshot // depth first, parents before children
+	CurrentSnapshot string     // name of the current snapshot, empty without snapshots
+	// Values keeps every key=value line, for settings without a typed field.
+	Values map[string]string
+}
+
+// NIC is an enabled network adapter.
+type NIC struct {
+	Index          int    // 1 to 8, as in --nic<Index>
+	Attachment     string // nat, intnet, natnetwork, bridged, hostonly, generic, null
+	Network        string // internal network, NAT network, bridged or host only interface, depending on Attachment
+	MACAddress     string // 08:00:27:...
+	CableConnected bool
+	Forwardings    []NATRule // NAT attachment only
+}
+
+// NATRule is a port forwarding rule of a NAT adapter.
+type NATRule struct {
+	Name      string
+	Protocol  string // tcp or udp
+	HostIP    string // empty for every interface
+	HostPort  string
+	GuestIP   string
+	GuestPort string
+}
+
+func (r NATRule) String() string {
+	return strings.Join([]string{r.Name, r.Protocol, r.HostIP, r.HostPort, r.GuestIP, r.GuestPort}, ",")
+}
+
+type StorageController struct {
+	Name        string // SATA or IDE for VMs created by xbee
+	Type        string // IntelAhci, PIIX4...
+	PortCount   int
+	Attachments []Attachment // media attached, empty slots are omitted
+}
+
+// Attachment is a medium attached to a controller slot.
+type Attachment struct {
+	Port   int
+	Device int
+	Medium string // path of the medium, or emptydrive for a dvd drive without disc
+	UUID   string
+}
+
+type SharedFolder struct {
+	Name      string
+	HostPath  string
+	Transient bool
+}
+
+type Snapshot struct {
+	Name        string
+	UUID        string
+	Description string
+	Parent      string // UUID of the parent snapshot, empty for the root one
+}
+
+// ShowMachineInfo returns the configuration of vmName. The error is NotFound when no such VM is registered.
+func ShowMachineInfo(ctx context.Context, vmName string) (*MachineInfo, *VboxError) {
+	out, err := VboxFrom(vmName).showVmInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMachineInfo(out), nil
+}
+
+var (
+	nicKeyRegexp        = regexp.MustCompile(`^(nic|macaddress|cableconnected|intnet|nat-network|bridgeadapter|hostonlyadapter)(\d)$`)
+	forwardingKeyRegexp = regexp.MustCompile(`^Forwarding\(\d+\)$`)
+	controllerKeyRegexp = regexp.MustCompile(`^storagecontroller(name|type|portcount)(\d+)$`)
+	mediumKeyRegexp     = regexp.MustCompile(`^(.+?)-(ImageUUID-)?(\d+)-(\d+)$`)
+	sharedFolderRegexp  = regexp.MustCompile(`^SharedFolder(Name|Path)(Machine|Transient)Mapping(\d+)$`)
+	snapshotKeyRegexp   = regexp.MustCompile(`^Snapshot(Name|UUID|Description)((?:-\d+)*)$`)
+)
+
+// ParseMachineInfo reads the output of showvminfo --machinereadable.
+func ParseMachineInfo(out string) *MachineInfo {
+	result := &MachineInfo{Values: map[string]string{}}
+	nics := map[int]*NIC{}
+	var lastNAT *NIC
+	var forwardings []NATRule // rules found before any NAT adapter
+	controllers := map[int]*StorageController{}
+	media := map[string]*Attachment{} // by controller-port-device
+	folders := map[string]*SharedFolder{}
+	var folderKeys []string
+	snapshots := map[string]*Snapshot{}
+	var snapshotKeys []string
+	nic := func(index int) *NIC {
+		n, ok := nics[index]
+		if !ok {
+			n = &NIC{Index: index}
+			nics[index] = n
+		}
+		return n
+	}
+	for _, kv := range (&Parser{content: out}).asPairs() {
+		key, value := kv.Key, kv.Value
+		result.Values[key] = value
+		switch key {
+		case "name":
+			result.Name = value
+		case "UUID":
+			result.UUID = value
+		case "ostype":
+			result.OSType = value
+		case "groups":
+			result.Groups = strings.Split(value, ",")
+		case "CfgFile":
+			result.CfgFile = value
+		case "VMState":
+			result.State = value
+		case "VMStateChangeTime":
+			result.StateChangeTime = value
+		case "memory":
+			result.Memory, _ = strconv.Atoi(value)
+		case "cpus":
+			result.CPUs, _ = strconv.Atoi(value)
+		case "firmware":
+			result.Firmware = value
+		case "CurrentSnapshotName":
+			result.CurrentSnapshot = value
+		}
+		if m := nicKeyRegexp.FindStringSubmatch(key); m != nil {
+			index, _ := strconv.Atoi(m[2])
+			n := nic(index)
+			switch m[1] {
+			case "nic":
+				n.Attachment = value
+				if value == "nat" {
+					lastNAT = n
+				}
+			case "macaddress":
+				n.MACAddress = macAddress(value)
+			case "cableconnected":
+				n.CableConnected = value == "on"
+			default:
+				n.Network = value
+			}
+		} else if forwardingKeyRegexp.MatchString(key) {
+			rule := natRuleFrom(value)
+			if lastNAT != nil {
+				lastNAT.Forwardings = append(lastNAT.Forwardings, rule)
+			} else {
+				forwardings = append(forwardings, rule)
+			}
+		} else if m := controllerKeyRegexp.FindStringSubmatch(key); m != nil {
+			index, _ := strconv.Atoi(m[2])
+			c, ok := controllers[index]
+			if !ok {
+				c = &StorageController{}
+				controllers[index] = c
+			}
+			switch m[1] {
+			case "name":
+				c.Name = value
+			case "type":
+				c.Type = value
+			case "portcount":
+				c.PortCount, _ = strconv.Atoi(value)
+			}
+		} else if m := snapshotKeyRegexp.FindStringSubmatch(key); m != nil {
+			s, ok := snapshots[m[2]]
+			if !ok {
+				s = &Snapshot{}
+				snapshots[m[2]] = s
+				snapshotKeys = append(snapshotKeys, m[2])
+			}
+			switch m[1] {
+			case "Name":
+				s.Name = value
+			case "UUID":
+				s.UUID = value
+			case "Description":
+				s.Description = value
+			}
+		} else if m := mediumKeyRegexp.FindStringSubmatch(key); m != nil {
+			id := m[1] + "-" + m[3] + "-" + m[4]
+			a, ok := media[id]
+			if !ok {
+				port, _ := strconv.Atoi(m[3])
+				device, _ := strconv.Atoi(m[4])
+				a = &Attachment{Port: port, Device: device}
+				media[id] = a
+			}
+			if m[2] == "" {
+				a.Medium = value
+			} else {
+				a.UUID = value
+			}
+		} else if m := sharedFolderRegexp.FindStringSubmatch(key); m != nil {
+			id := m[2] + m[3]
+			sf, ok := folders[id]
+			if !ok {
+				sf = &SharedFolder{Transient: m[2] == "Transient"}
+				folders[id] = sf
+				folderKeys = append(folderKeys, id)
+			}
+			if m[1] == "Name" {
+				sf.Name = value
+			} else {
+				sf.HostPath = value
+			}
+		}
+	}
+	for i := 1; i <= 8; i++ {
+		if n, ok := nics[i]; ok && n.Attachment != "" && n.Attachment != "none" {
+			result.NICs = append(result.NICs, *n)
+		}
+	}
+	if len(forwardings) > 0 {
+		// no adapter printed before the rules; give them to the first NAT adapter
+		for i := range result.NICs {
+			if result.NICs[i].Attachment == "nat" {
+				result.NICs[i].Forwardings = append(forwardings, result.NICs[i].Forwardings...)
+				break
+			}
+		}
+	}
+	for i := 0; i < len(controllers); i++ {
+		c, ok := controllers[i]
+		if !ok {
+			continue
+		}
+		for port := 0; port < c.PortCount; port++ {
+			for device := 0; device < 2; device++ {
+				if a, ok := media[c.Name+"-"+strconv.Itoa(port)+"-"+strconv.Itoa(device)]; ok && a.Medium != "" && a.Medium != "none" {
+					c.Attachments = append(c.Attachments, *a)
+				}
+			}
+		}
+		result.Controllers = append(result.Controllers, *c)
+	}
+	for _, id := range folderKeys {
+		result.SharedFolders = append(result.SharedFolders, *folders[id])
+	}
+	for _, id := range snapshotKeys {
+		s := snapshots[id]
+		if index := strings.LastIndex(id, "-"); index != -1 {
+			if parent, ok := snapshots[id[:index]]; ok {
+				s.Parent = parent.UUID
+			}
+		}
+		result.Snapshots = append(result.Snapshots, *s)
+	}
+	return result
+}
+
+func natRuleFrom(value string) NATRule {
+	fields := strings.Split(value, ",")
+	for len(fields) < 6 {
+		fields = append(fields, "")
+	}
+	return NATRule{Name: fields[0], Protocol: fields[1], HostIP: fields[2], HostPort: fields[3], GuestIP: fields[4], GuestPort: fields[5]}
+}
+
+// macAddress inserts colons in the MAC address printed by VBoxManage (080027C1A2B3).
+func macAddress(value string) string {
+	if len(value) != 12 {
+		return value
+	}
+	return value[0:2] + ":" + value[2:4] + ":" + value[4:6] + ":" + value[6:8] + ":" + value[8:10] + ":" + value[10:12]
+}
+
+// NIC returns the adapter number index, nil if it is disabled.
+func (m *MachineInfo) NIC(index int) *NIC {
+	for i := range m.NICs {
+		if m.NICs[i].Index == index {
+			return &m.NICs[i]
+		}
+	}
+	return nil
+}
+
+// Forwardings returns the rules of every NAT adapter.
+func (m *MachineInfo) Forwardings() (result []NATRule) {
+	for _, n := range m.NICs {
+		result = append(result, n.Forwardings...)
+	}
+	return
+}
+
+func (m *MachineInfo) Controller(name string) *StorageController {
+	for i := range m.Controllers {
+		if m.Controllers[i].Name == name {
+			return &m.Controllers[i]
+		}
+	}
+	return nil
+}
+
+// Attachment returns the medium attached at port and device, nil if the slot is empty.
+func (c *StorageController) Attachment(port int, device int) *Attachment {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Attachments {
+		if c.Attachments[i].Port == port && c.Attachments[i].Device == device {
+			return &c.Attachments[i]
+		}
+	}
+	return nil
+}
+
+func (m *MachineInfo) SharedFolder(name string) *SharedFolder {
+	for i := range m.SharedFolders {
+		if m.SharedFolders[i].Name == name {
+			return &m.SharedFolders[i]
+		}
+	}
+	return nil
+}
+
+func (m *MachineInfo) Snapshot(name string) *Snapshot {
+	for i := range m.Snapshots {
+		if m.Snapshots[i].Name == name {
+			return &m.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+// Recording tells whether the display is recorded to a video file, videocap before VirtualBox 6.
+func (m *MachineInfo) Recording() bool {
+	return m.Values["recording_enabled"] == "on" || m.Values["videocap"] == "on"
+}
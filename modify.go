@@ -0,0 +1,95 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+)
+
+// ModifyBatch collects modifyvm settings and applies them with a single VBoxManage invocation,
+// so that the VM session lock is taken once instead of once per setting.
+type ModifyBatch struct {
+	vbox     *Vbox
+	settings []modifySetting
+	err      *cmd.XbeeError // why a setting could not be built, returned by Flush
+}
+
+type modifySetting struct {
+	label string // human readable, used to report which setting failed
+	args  []string
+}
+
+func (vbox *Vbox) Batch() *ModifyBatch {
+	return &ModifyBatch{vbox: vbox}
+}
+
+// caps returns capabilities used to build settings. When the version is unknown, Flush fails with the reason,
+// settings queued meanwhile use the oldest syntax.
+func (b *ModifyBatch) caps() *Capabilities {
+	caps, err := b.vbox.caps()
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return CapabilitiesFor(VboxVersion{})
+	}
+	return caps
+}
+
+// Set queues modifyvm args, described by label in error messages.
+func (b *ModifyBatch) Set(label string, args ...string) *ModifyBatch {
+	b.settings = append(b.settings, modifySetting{label: label, args: args})
+	return b
+}
+
+func (b *ModifyBatch) AddNATRule(key string, hostPort string, guestPort string) *ModifyBatch {
+	return b.Set(fmt.Sprintf("NAT rule %s (host port %s to guest port %s)", key, hostPort, guestPort),
+		b.caps().NATRuleOption(1), fmt.Sprintf("%s,tcp,,%s,,%s", key, hostPort, guestPort))
+}
+
+func (b *ModifyBatch) DeleteNATRule(key string) *ModifyBatch {
+	return b.Set(fmt.Sprintf("deletion of NAT rule %s", key), b.caps().NATRuleOption(1), "delete", key)
+}
+
+func (b *ModifyBatch) Len() int {
+	return len(b.settings)
+}
+
+func (b *ModifyBatch) args() []string {
+	args := []string{"modifyvm", b.vbox.name}
+	for _, s := range b.settings {
+		args = append(args, s.args...)
+	}
+	return args
+}
+
+// Flush applies queued settings and empties the batch.
+// VirtualBox does not save any setting of a modifyvm which fails; settings are then applied one by one,
+// to find and report the one responsible for the failure.
+func (b *ModifyBatch) Flush(ctx context.Context) *cmd.XbeeError {
+	settings, err := b.settings, b.err
+	b.settings, b.err = nil, nil
+	if err != nil {
+		return err
+	}
+	if len(settings) == 0 {
+		return nil
+	}
+	batch := &ModifyBatch{vbox: b.vbox, settings: settings}
+	_, vErr := b.vbox.run(ctx, batch.args()...)
+	if vErr == nil {
+		return nil
+	}
+	if len(settings) == 1 {
+		return cmd.Error("vm %s : cannot apply %s : %s", b.vbox.name, settings[0].label, vErr)
+	}
+	log2.Debugf("vm %s : modifyvm of %d settings failed (%s), apply them one by one", b.vbox.name, len(settings), vErr.Message())
+	for _, s := range settings {
+		single := &ModifyBatch{vbox: b.vbox, settings: []modifySetting{s}}
+		if _, err := b.vbox.run(ctx, single.args()...); err != nil {
+			return cmd.Error("vm %s : cannot apply %s : %s", b.vbox.name, s.label, err)
+		}
+	}
+	return nil
+}
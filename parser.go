@@ -1,44 +1,202 @@
 package virtualbox
 
 import (
-	"bufio"
 	"strings"
 )
 
+// Parser reads the two output styles of VBoxManage:
+//   - key=value lines of --machinereadable (showvminfo, natnetwork list...)
+//   - "Key:   value" blocks separated by blank lines of list commands (list dhcpservers, list hdds...)
 type Parser struct {
 	content string
 }
 
+// asList returns one map per block of a colon list. Nested keys are joined with "/".
 func (p *Parser) asList() (result []map[string]string) {
-	scanner := bufio.NewScanner(strings.NewReader(p.content))
-	current := make(map[string]string)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) == 0 {
+	for _, record := range ParseColonList(p.content) {
+		result = append(result, pairsToMap(record))
+	}
+	return
+}
+
+func (p *Parser) asMap() map[string]string {
+	return pairsToMap(p.asPairs())
+}
+
+func (p *Parser) asPairs() []Pair {
+	return ParseMachineReadable(p.content)
+}
+
+// Pair is one key and its value, in the order printed by VBoxManage.
+type Pair struct {
+	Key   string
+	Value string
+}
+
+// pairsToMap keeps the last value of duplicated keys.
+func pairsToMap(pairs []Pair) map[string]string {
+	result := make(map[string]string, len(pairs))
+	for _, kv := range pairs {
+		result[kv.Key] = kv.Value
+	}
+	return result
+}
+
+// ParseMachineReadable reads key=value lines of a --machinereadable output. Pairs are kept in order,
+// duplicated keys included, since the meaning of some keys (Forwarding(n)) depends on the preceding ones.
+//
+// Keys are bare (memory=2048) or quoted ("SATA-0-0"="..."). Quoted values may contain escaped quotes and
+// backslashes (\" and \\), '=' and new lines. Text following the closing quote is kept (VideoMode="1024,768,32"@0,0 1).
+// Lines which are not key=value (warnings) are ignored.
+func ParseMachineReadable(content string) (result []Pair) {
+	lines := splitLines(content)
+	for i := 0; i < len(lines); i++ {
+		key, rest, ok := splitKey(lines[i])
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(rest, `"`) {
+			result = append(result, Pair{Key: key, Value: strings.TrimSpace(rest)})
+			continue
+		}
+		value, consumed, ok := quotedValue(lines[i:], rest[1:])
+		if !ok {
+			// unterminated quote, keep the line only
+			value = strings.TrimSuffix(rest[1:], `"`)
+			consumed = 0
+		}
+		result = append(result, Pair{Key: key, Value: value})
+		i += consumed
+	}
+	return
+}
+
+func splitLines(content string) []string {
+	return strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+}
+
+// splitKey separates the key of a key=value line from the raw text following '='.
+func splitKey(line string) (key string, rest string, ok bool) {
+	if strings.HasPrefix(line, `"`) {
+		for j := 1; j < len(line); j++ {
+			switch line[j] {
+			case '\\':
+				j++
+			case '"':
+				if j+1 < len(line) && line[j+1] == '=' {
+					return unescape(line[1:j]), line[j+2:], true
+				}
+				return "", "", false
+			}
+		}
+		return "", "", false
+	}
+	index := strings.Index(line, "=")
+	if index <= 0 {
+		return "", "", false
+	}
+	key = strings.TrimSpace(line[:index])
+	if key == "" || strings.Contains(key, `"`) {
+		return "", "", false
+	}
+	return key, line[index+1:], true
+}
+
+// quotedValue reads a quoted value starting at text, the first line after the opening quote.
+// A quote closes the value when no other quote follows on its line, so that unescaped quotes
+// printed by old VirtualBox versions stay in the value. consumed is the number of extra lines read.
+func quotedValue(lines []string, text string) (value string, consumed int, ok bool) {
+	b := &strings.Builder{}
+	for {
+		for j := 0; j < len(text); j++ {
+			c := text[j]
+			if c == '\\' && j+1 < len(text) && (text[j+1] == '"' || text[j+1] == '\\') {
+				b.WriteByte(text[j+1])
+				j++
+				continue
+			}
+			if c == '"' && !strings.Contains(text[j+1:], `"`) {
+				b.WriteString(text[j+1:])
+				return b.String(), consumed, true
+			}
+			b.WriteByte(c)
+		}
+		consumed++
+		if consumed >= len(lines) {
+			return "", 0, false
+		}
+		b.WriteByte('\n')
+		text = lines[consumed]
+	}
+}
+
+func unescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(s)
+}
+
+// ParseColonList reads the blocks of a list command, one slice of pairs per block.
+//
+// A line is split on its first ": " (or a trailing ':'), so that values containing colons (windows paths,
+// IPv6 addresses, times) are kept whole. A line without separator is a header, with an empty value.
+// Indented lines below a key without value are nested keys, named parent/key; other indented lines
+// continue the value of the key above them, separated by new lines. Several blank lines count as one.
+func ParseColonList(content string) (result [][]Pair) {
+	type parent struct {
+		indent int
+		key    string
+		index  int // in current
+		empty  bool
+	}
+	var current []Pair
+	var stack []parent
+	flush := func() {
+		if len(current) > 0 {
 			result = append(result, current)
-			current = make(map[string]string)
-		} else {
-			splitted := strings.Split(line, ":")
-			current[splitted[0]] = strings.TrimSpace(splitted[1])
 		}
+		current = nil
+		stack = nil
 	}
-	if len(current) > 0 {
-		result = append(result, current)
+	for _, line := range splitLines(content) {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			flush()
+			continue
+		}
+		text := strings.TrimLeft(line, " \t")
+		indent := len(line) - len(text)
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		key, value, hasSeparator := cutColon(text)
+		if indent > 0 && len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if !top.empty || !hasSeparator {
+				// continuation of the value above
+				kv := &current[top.index]
+				if kv.Value == "" {
+					kv.Value = text
+				} else {
+					kv.Value += "\n" + text
+				}
+				continue
+			}
+			key = top.key + "/" + key
+		} else if !hasSeparator {
+			key, value = text, ""
+		}
+		current = append(current, Pair{Key: key, Value: value})
+		stack = append(stack, parent{indent: indent, key: key, index: len(current) - 1, empty: value == ""})
 	}
+	flush()
 	return
 }
 
-func (p *Parser) asMap() map[string]string {
-	scanner := bufio.NewScanner(strings.NewReader(p.content))
-	result := make(map[string]string)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "=") {
-			splitted := strings.Split(line, "=")
-			key := strings.Trim(splitted[0], "\"")
-			value := strings.Trim(splitted[1], "\"")
-			result[key] = value
-		}
+func cutColon(text string) (key string, value string, ok bool) {
+	if index := strings.Index(text, ": "); index != -1 {
+		return strings.TrimSpace(text[:index]), strings.TrimSpace(text[index+2:]), true
 	}
-	return result
+	if strings.HasSuffix(text, ":") {
+		return strings.TrimSpace(strings.TrimSuffix(text, ":")), "", true
+	}
+	return "", "", false
 }
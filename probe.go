@@ -0,0 +1,173 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/util"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ProbeTCP     = "tcp"     // Port is open in the guest
+	ProbeHTTP    = "http"    // Path on Port answers 2xx, through the NAT rule of Port
+	ProbeCommand = "command" // Command exits 0 over SSH
+)
+
+// Probe is a readiness check of a host. Up returns once every probe of every host passed.
+type Probe struct {
+	Name     string `json:"name,omitempty"`
+	Type     string `json:"type"`
+	Port     int    `json:"port,omitempty"` // guest port
+	Path     string `json:"path,omitempty"`
+	Command  string `json:"command,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`  // duration, 5m by default
+	Interval string `json:"interval,omitempty"` // duration between attempts, 5s by default
+}
+
+// probeAttemptTimeout bounds a single attempt, so that a hanging one does not hide the next ones.
+const probeAttemptTimeout = 10 * time.Second
+
+func (p Probe) String() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	switch p.Type {
+	case ProbeTCP:
+		return fmt.Sprintf("tcp %d", p.Port)
+	case ProbeHTTP:
+		return fmt.Sprintf("http %d%s", p.Port, p.Path)
+	case ProbeCommand:
+		return fmt.Sprintf("command [%s]", p.Command)
+	}
+	return p.Type
+}
+
+func (p Probe) durations() (timeout time.Duration, interval time.Duration, err *cmd.XbeeError) {
+	timeout, interval = 5*time.Minute, 5*time.Second
+	var err2 error
+	if p.Timeout != "" {
+		if timeout, err2 = time.ParseDuration(p.Timeout); err2 != nil {
+			return 0, 0, cmd.Error("probe %s : invalid timeout %s (examples: 30s, 2m)", p, p.Timeout)
+		}
+	}
+	if p.Interval != "" {
+		if interval, err2 = time.ParseDuration(p.Interval); err2 != nil {
+			return 0, 0, cmd.Error("probe %s : invalid interval %s (examples: 500ms, 5s)", p, p.Interval)
+		}
+	}
+	return
+}
+
+func (p Probe) validate() *cmd.XbeeError {
+	switch p.Type {
+	case ProbeTCP, ProbeHTTP:
+		if p.Port <= 0 {
+			return cmd.Error("probe %s : port is required", p)
+		}
+	case ProbeCommand:
+		if p.Command == "" {
+			return cmd.Error("probe %s : command is required", p)
+		}
+	default:
+		return cmd.Error("probe %s : unknown type %q, expected %s, %s or %s", p, p.Type, ProbeTCP, ProbeHTTP, ProbeCommand)
+	}
+	_, _, err := p.durations()
+	return err
+}
+
+// check runs one attempt of p and returns its output, which tells why it failed.
+func (vm *Vm) check(ctx context.Context, p Probe) (string, bool) {
+	switch p.Type {
+	case ProbeTCP:
+		return vm.checkInGuest(fmt.Sprintf("bash -c '</dev/tcp/127.0.0.1/%d'", p.Port))
+	case ProbeHTTP:
+		return vm.checkHTTP(ctx, p)
+	}
+	return vm.checkInGuest(p.Command)
+}
+
+// checkInGuest runs command in the guest, killed by timeout after probeAttemptTimeout.
+func (vm *Vm) checkInGuest(command string) (string, bool) {
+	out, err := vm.conn.RunCommandToOut(fmt.Sprintf("timeout %d sh -c %s 2>&1", int(probeAttemptTimeout.Seconds()), shellQuote(command)))
+	if err != nil {
+		return strings.TrimSpace(out + " " + err.Error()), false
+	}
+	return out, true
+}
+
+func (vm *Vm) checkHTTP(ctx context.Context, p Probe) (string, bool) {
+	var hostPort string
+	for _, rule := range vm.info.Machine().Forwardings() {
+		if rule.GuestPort == fmt.Sprint(p.Port) {
+			hostPort = rule.HostPort
+		}
+	}
+	if hostPort == "" {
+		return fmt.Sprintf("guest port %d is not exposed, add it to the ports of the host", p.Port), false
+	}
+	path := p.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(currentHypervisor().Address(), hostPort), path)
+	ctx, cancel := context.WithTimeout(ctx, probeAttemptTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err.Error(), false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err.Error(), false
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	out := fmt.Sprintf("GET %s : %s %s", url, resp.Status, strings.TrimSpace(string(body)))
+	return out, resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+func (vm *Vm) waitProbe(ctx context.Context, p Probe) *cmd.XbeeError {
+	timeout, interval, err := p.durations()
+	if err != nil {
+		return err
+	}
+	log2.Infof("%s : wait for probe %s...", vm.HostName, p)
+	deadline := time.Now().Add(timeout)
+	for {
+		out, ok := vm.check(ctx, p)
+		if ok {
+			log2.Infof("%s : probe %s passed", vm.HostName, p)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return cmd.Error("%s : probe %s did not pass within %v, last output : %s", vm.HostName, p, timeout, strings.TrimSpace(out))
+		}
+		log2.Debugf("%s : probe %s not passed yet : %s", vm.HostName, p, strings.TrimSpace(out))
+		select {
+		case <-ctx.Done():
+			return cmd.Error("%s : probe %s interrupted (%v), last output : %s", vm.HostName, p, ctx.Err(), strings.TrimSpace(out))
+		case <-time.After(interval):
+		}
+	}
+}
+
+// waitProbes waits for the probes of the host together.
+func (vm *Vm) waitProbes(ctx context.Context) *cmd.XbeeError {
+	if len(vm.Host.Specification.Probes) == 0 {
+		return nil
+	}
+	var list []util.Executor
+	for _, p := range vm.Host.Specification.Probes {
+		p := p
+		list = append(list, func(ctx context.Context) *cmd.XbeeError {
+			return vm.waitProbe(ctx, p)
+		})
+	}
+	return util.Execute(ctx, list...)
+}
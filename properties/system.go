@@ -11,14 +11,32 @@ import (
 var system struct {
 	properties map[string]string
 	once       sync.Once
+	source     func() (string, error)
 }
 
-func initSystem() map[string]string {
+// SetSystemPropertiesSource replaces the function returning output of "VBoxManage list systemproperties".
+// Properties already loaded are discarded.
+func SetSystemPropertiesSource(source func() (string, error)) {
+	system.source = source
+	system.properties = nil
+	system.once = sync.Once{}
+}
+
+func listSystemProperties() (string, error) {
+	if system.source != nil {
+		return system.source()
+	}
 	c := exec2.NewCommand(VboxPath(), "list", "systemproperties").Quiet().WithResult()
 	if err := c.Run(nil); err != nil {
+		return "", err
+	}
+	return c.Result(), nil
+}
+
+func initSystem() map[string]string {
+	if out, err := listSystemProperties(); err != nil {
 		panic(err)
 	} else {
-		out := c.Result()
 		lines := strings.Split(out, "\n")
 		result := make(map[string]string)
 		for _, line := range lines {
@@ -44,6 +62,11 @@ func defaultMachineFolder() string {
 	return fromSystem("Default machine folder")
 }
 
+// MachineFolder is the folder where VirtualBox creates VM folders.
+func MachineFolder() newfs.Folder {
+	return newfs.NewFolder(defaultMachineFolder())
+}
+
 func VmFolder(name string) newfs.Folder {
 	return newfs.NewFolder(defaultMachineFolder()).ChildFolder(name)
 }
@@ -13,13 +13,23 @@ type Provider struct {
 
 func (pv Provider) Up() ([]*provider.InstanceInfo, *cmd.XbeeError) {
 	ctx := context.Background()
-	vms := VmsFrom(ctx)
+	vms, err := VmsFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if err := EnsureXbeenetExist(ctx); err != nil {
 		return nil, err
 	}
+	if err := vms.Settle(ctx); err != nil {
+		return nil, err
+	}
 	downOrNotExisting, other := vms.NotExistingOrDown()
+	suspended, other := other.Suspended()
 	for _, vm := range other {
-		log2.Warnf("host %s is in state %s", vm.HostName, vm.info.State())
+		log2.Infof("host %s is in state %s", vm.HostName, vm.info.State())
+	}
+	if err := suspended.Resume(ctx); err != nil {
+		return nil, err
 	}
 	if err := downOrNotExisting.Up(ctx); err != nil {
 		return nil, err
@@ -29,7 +39,10 @@ func (pv Provider) Up() ([]*provider.InstanceInfo, *cmd.XbeeError) {
 
 func (pv Provider) Delete() *cmd.XbeeError {
 	ctx := context.Background()
-	vms := VmsFrom(ctx)
+	vms, err := VmsFrom(ctx)
+	if err != nil {
+		return err
+	}
 	existing, notExisting := vms.Existing()
 	if len(notExisting) > 0 {
 		log2.Infof("instances %v already do not exist", notExisting.Names())
@@ -44,7 +57,10 @@ func (pv Provider) Delete() *cmd.XbeeError {
 
 func (pv Provider) InstanceInfos() ([]*provider.InstanceInfo, *cmd.XbeeError) {
 	ctx := context.Background()
-	vms := VmsFrom(ctx)
+	vms, err := VmsFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var result []*provider.InstanceInfo
 	for _, vm := range vms {
 		info, err := vm.InstanceInfo(ctx)
@@ -58,12 +74,15 @@ func (pv Provider) InstanceInfos() ([]*provider.InstanceInfo, *cmd.XbeeError) {
 
 func (pv Provider) Image() *cmd.XbeeError {
 	ctx := context.Background()
-	vms := VmsFrom(ctx)
+	vms, err := VmsFrom(ctx)
+	if err != nil {
+		return err
+	}
 	var list []util.Executor
 	for _, vm := range vms {
 		list = append(list, vm.ExportToVmdk)
 	}
-	err := util.Execute(ctx, list...)
+	err = util.Execute(ctx, list...)
 	if err != nil {
 		return err
 	}
@@ -71,9 +90,57 @@ func (pv Provider) Image() *cmd.XbeeError {
 	return nil
 }
 
+// Suspend saves running VMs to disk, freeing their memory. Resume or Up restarts them where they stopped.
+func (pv Provider) Suspend() *cmd.XbeeError {
+	ctx := context.Background()
+	vms, err := VmsFrom(ctx)
+	if err != nil {
+		return err
+	}
+	if err := vms.Settle(ctx); err != nil {
+		return err
+	}
+	running, other := vms.Running()
+	for _, vm := range other {
+		log2.Infof("host %s is in state %s, nothing to suspend", vm.HostName, vm.info.State())
+	}
+	return running.Suspend(ctx)
+}
+
+// Resume restarts suspended VMs, without reconfiguring them.
+func (pv Provider) Resume() ([]*provider.InstanceInfo, *cmd.XbeeError) {
+	ctx := context.Background()
+	vms, err := VmsFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := vms.Settle(ctx); err != nil {
+		return nil, err
+	}
+	suspended, other := vms.Suspended()
+	for _, vm := range other {
+		log2.Infof("host %s is in state %s, nothing to resume", vm.HostName, vm.info.State())
+	}
+	if err := suspended.Resume(ctx); err != nil {
+		return nil, err
+	}
+	return pv.InstanceInfos()
+}
+
 func (pv Provider) Down() *cmd.XbeeError {
 	ctx := context.Background()
-	vms := VmsFrom(ctx)
+	vms, err := VmsFrom(ctx)
+	if err != nil {
+		return err
+	}
+	if err := vms.Settle(ctx); err != nil {
+		return err
+	}
+	// paused and saved VMs are stopped too, their state is lost
+	existing, _ := vms.Existing()
+	if err := existing.Stop(ctx); err != nil {
+		return err
+	}
 	down, _ := vms.Down()
 	for _, vm := range down {
 		if err := vm.AfterDown(ctx); err != nil {
@@ -82,3 +149,100 @@ func (pv Provider) Down() *cmd.XbeeError {
 	}
 	return nil
 }
+
+// TakeSnapshot snapshots the given hosts, every host of the environment when none is given.
+func (pv Provider) TakeSnapshot(name string, description string, hostNames ...string) *cmd.XbeeError {
+	ctx := context.Background()
+	vms, err := selectVms(ctx, hostNames...)
+	if err != nil {
+		return err
+	}
+	return vms.TakeSnapshot(ctx, name, description)
+}
+
+// RestoreSnapshot restores the given hosts, every host of the environment when none is given, and starts them.
+func (pv Provider) RestoreSnapshot(name string, hostNames ...string) ([]*provider.InstanceInfo, *cmd.XbeeError) {
+	ctx := context.Background()
+	vms, err := selectVms(ctx, hostNames...)
+	if err != nil {
+		return nil, err
+	}
+	if err := vms.RestoreSnapshot(ctx, name); err != nil {
+		return nil, err
+	}
+	return pv.InstanceInfos()
+}
+
+func (pv Provider) DeleteSnapshot(name string, hostNames ...string) *cmd.XbeeError {
+	ctx := context.Background()
+	vms, err := selectVms(ctx, hostNames...)
+	if err != nil {
+		return err
+	}
+	return vms.DeleteSnapshot(ctx, name)
+}
+
+// Snapshots returns snapshots by host name, of the given hosts or of every host of the environment.
+func (pv Provider) Snapshots(hostNames ...string) (map[string][]VmSnapshot, *cmd.XbeeError) {
+	ctx := context.Background()
+	vms, err := selectVms(ctx, hostNames...)
+	if err != nil {
+		return nil, err
+	}
+	return vms.Snapshots(ctx)
+}
+
+// Plan logs and returns differences between the specification of the given hosts, every host when none is given,
+// and their VMs. Nothing is changed.
+func (pv Provider) Plan(hostNames ...string) ([]Change, *cmd.XbeeError) {
+	ctx := context.Background()
+	vms, err := selectVms(ctx, hostNames...)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := vms.Plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		log2.Infof("hosts match their specification")
+	}
+	for _, change := range changes {
+		log2.Infof("%s", change)
+	}
+	return changes, nil
+}
+
+// Reconcile applies the plan to the given hosts, every host when none is given. Changes which need a stopped VM
+// are not applied to running ones: they are returned, and applied by a down then an up.
+func (pv Provider) Reconcile(hostNames ...string) ([]Change, *cmd.XbeeError) {
+	ctx := context.Background()
+	vms, err := selectVms(ctx, hostNames...)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := vms.Reconcile(ctx)
+	for _, change := range pending {
+		log2.Warnf("%s : stop the host to apply it", change)
+	}
+	return pending, err
+}
+
+// selectVms returns VMs of the given hosts, every host of the environment when none is given.
+func selectVms(ctx context.Context, hostNames ...string) (Vms, *cmd.XbeeError) {
+	vms, err := VmsFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return vms.Select(hostNames...)
+}
+
+// ConsoleLog returns the serial console of hostName, the last lines only when lines is not 0.
+func (pv Provider) ConsoleLog(hostName string, lines int) (string, *cmd.XbeeError) {
+	ctx := context.Background()
+	vms, err := selectVms(ctx, hostName)
+	if err != nil {
+		return "", err
+	}
+	return vms[0].ConsoleLog(lines)
+}
@@ -0,0 +1,264 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/newfs"
+	"github.com/iodasolutions/xbee-common/util"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Change is a difference between the specification of a host and the configuration of its VM.
+type Change struct {
+	Host      string
+	Setting   string
+	Current   string // empty when the VM lacks the setting
+	Desired   string // empty when the setting must be removed
+	NeedsStop bool   // VirtualBox applies it to a powered off VM only
+	apply     func(ctx context.Context) *cmd.XbeeError
+}
+
+func (c Change) String() string {
+	current, desired := c.Current, c.Desired
+	if current == "" {
+		current = "none"
+	}
+	if desired == "" {
+		desired = "none"
+	}
+	result := fmt.Sprintf("%s : %s %s -> %s", c.Host, c.Setting, current, desired)
+	if c.NeedsStop {
+		result += " (needs a stopped vm)"
+	}
+	return result
+}
+
+// Plan compares the VM with the specification of its host. Ports are compared for running VMs only:
+// rules of a stopped VM are deleted by AfterDown and added again by Start.
+func (vm *Vm) Plan() (result []Change) {
+	machine := vm.info.Machine()
+	vb := vm.Vbox()
+	add := func(setting string, current string, desired string, needsStop bool, apply func(ctx context.Context) *cmd.XbeeError) {
+		result = append(result, Change{Host: vm.HostName, Setting: setting, Current: current, Desired: desired, NeedsStop: needsStop, apply: apply})
+	}
+	spec := vm.Host.Specification
+	if spec.Memory > 0 && machine.Memory != spec.Memory {
+		add("memory", strconv.Itoa(machine.Memory), strconv.Itoa(spec.Memory), true, func(ctx context.Context) *cmd.XbeeError {
+			return vb.Batch().Set("memory", "--memory", strconv.Itoa(spec.Memory)).Flush(ctx)
+		})
+	}
+	if spec.Cpus > 0 && machine.CPUs != spec.Cpus {
+		add("cpus", strconv.Itoa(machine.CPUs), strconv.Itoa(spec.Cpus), true, func(ctx context.Context) *cmd.XbeeError {
+			return vb.Batch().Set("cpus", "--cpus", strconv.Itoa(spec.Cpus)).Flush(ctx)
+		})
+	}
+	nat, intnet := machine.NIC(1), machine.NIC(2)
+	if nat == nil || nat.Attachment != "nat" || intnet == nil || intnet.Attachment != "intnet" || intnet.Network != DefaultNet() {
+		add("network adapters", describeNics(nat, intnet), "nic1 nat, nic2 intnet "+DefaultNet(), true, func(ctx context.Context) *cmd.XbeeError {
+			batch := vb.Batch()
+			vm.configureNic(batch)
+			return batch.Flush(ctx)
+		})
+	}
+	vm.planVolumes(add)
+	if state := vm.info.MachineState(); state == MachineRunning || state == MachinePaused {
+		vm.planPorts(add)
+	}
+	return
+}
+
+func describeNics(nics ...*NIC) string {
+	var parts []string
+	for i, nic := range nics {
+		switch {
+		case nic == nil:
+			parts = append(parts, fmt.Sprintf("nic%d none", i+1))
+		case nic.Network != "":
+			parts = append(parts, fmt.Sprintf("nic%d %s %s", i+1, nic.Attachment, nic.Network))
+		default:
+			parts = append(parts, fmt.Sprintf("nic%d %s", i+1, nic.Attachment))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// planVolumes detaches disks which are no more volumes of the host, before attaching missing ones on free ports.
+// Shared folders of removed volumes are left: their name does not tell which volume they were.
+func (vm *Vm) planVolumes(add func(string, string, string, bool, func(ctx context.Context) *cmd.XbeeError)) {
+	desired := map[string]*VboxVolume{}
+	var names []string
+	for name, volume := range vm.volumes {
+		if strings.HasPrefix(name, "/") {
+			hash := newfs.NewFolder(name).Path.Hash()
+			if _, ok := vm.info.SharedFolders()[hash]; !ok {
+				name := name
+				add("shared folder "+hash, "", name, true, func(ctx context.Context) *cmd.XbeeError {
+					return vm.addSharedFolder(ctx, name)
+				})
+			}
+		} else if volume != nil {
+			desired[volume.File().String()] = volume
+			names = append(names, volume.File().String())
+		}
+	}
+	attached := vm.info.AttachedVolumes()
+	var files []string
+	for file := range attached {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if _, ok := desired[file]; !ok {
+			port := attached[file]
+			add(fmt.Sprintf("volume on SATA port %d", port), file, "", true, func(ctx context.Context) *cmd.XbeeError {
+				log2.Infof("Detach volume %s from vm %s", file, vm.HostName)
+				return vm.Vbox().DetachMedium(ctx, port)
+			})
+		}
+	}
+	sort.Strings(names)
+	for _, file := range names {
+		if _, ok := attached[file]; !ok {
+			volume := desired[file]
+			add("volume "+volume.Name, "", file, true, func(ctx context.Context) *cmd.XbeeError {
+				if !currentHypervisor().Exists(volume.File().String()) {
+					if err := volume.create(ctx); err != nil {
+						return err
+					}
+				}
+				// ports freed by detached volumes are reused
+				if err := vm.refresh(ctx); err != nil {
+					return err
+				}
+				return volume.EnsureHostVolumeAttached(ctx, vm)
+			})
+		}
+	}
+}
+
+// planPorts compares exposed ports with rules of the running VM, which are changed with controlvm.
+func (vm *Vm) planPorts(add func(string, string, string, bool, func(ctx context.Context) *cmd.XbeeError)) {
+	current := map[string]NATRule{}
+	for _, rule := range vm.info.Machine().Forwardings() {
+		if strings.HasPrefix(rule.Name, "PRODUCT-") {
+			current[rule.Name] = rule
+		}
+	}
+	desired := map[string]string{}
+	for _, port := range vm.Ports {
+		desired[vm.info.natKeyFor(port)] = port
+	}
+	describe := func(hostPort string, guestPort string) string {
+		if hostPort == "" {
+			return "guest port " + guestPort
+		}
+		return fmt.Sprintf("host port %s to guest port %s", hostPort, guestPort)
+	}
+	var keys []string
+	for key := range current {
+		keys = append(keys, key)
+	}
+	for key := range desired {
+		if _, ok := current[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		key := key
+		rule, exists := current[key]
+		port, wanted := desired[key]
+		hostPort, guestPort, explicit := strings.Cut(port, ":")
+		if !explicit {
+			hostPort, guestPort = "", port
+		}
+		hostPort, guestPort = strings.TrimSpace(hostPort), strings.TrimSpace(guestPort)
+		if exists && wanted && (hostPort == "" || hostPort == rule.HostPort) && guestPort == rule.GuestPort {
+			continue
+		}
+		var currentS, desiredS string
+		if exists {
+			currentS = describe(rule.HostPort, rule.GuestPort)
+		}
+		if wanted {
+			desiredS = describe(hostPort, guestPort)
+		}
+		add("NAT rule "+key, currentS, desiredS, false, func(ctx context.Context) *cmd.XbeeError {
+			vb := vm.Vbox()
+			if exists {
+				if err := vb.DeleteLiveNATRule(ctx, key); err != nil {
+					return err
+				}
+			}
+			if !wanted {
+				return nil
+			}
+			hostPort, guestPort := vm.info.hostGuestPort(port)
+			return vb.AddLiveNATRule(ctx, key, hostPort, guestPort)
+		})
+	}
+}
+
+// Reconcile applies the changes of Plan which the state of the VM allows, and returns the other ones.
+func (vm *Vm) Reconcile(ctx context.Context) (pending []Change, err *cmd.XbeeError) {
+	off := vm.info.MachineState().Off()
+	for _, change := range vm.Plan() {
+		if change.NeedsStop && !off {
+			pending = append(pending, change)
+			continue
+		}
+		log2.Infof("%s : apply %s", vm.HostName, strings.TrimPrefix(change.String(), vm.HostName+" : "))
+		if err = change.apply(ctx); err != nil {
+			break
+		}
+	}
+	if refreshErr := vm.refresh(ctx); err == nil {
+		err = refreshErr
+	}
+	return
+}
+
+// Plan returns changes of existing VMs, by host name then setting.
+func (vms Vms) Plan(ctx context.Context) ([]Change, *cmd.XbeeError) {
+	if err := vms.Settle(ctx); err != nil {
+		return nil, err
+	}
+	existing, notExisting := vms.Existing()
+	for _, vm := range notExisting {
+		log2.Infof("host %s does not exist, Up creates it", vm.HostName)
+	}
+	var result []Change
+	for _, vm := range existing {
+		result = append(result, vm.Plan()...)
+	}
+	return result, nil
+}
+
+// Reconcile reconciles existing VMs in parallel, and returns changes which need a stopped VM.
+func (vms Vms) Reconcile(ctx context.Context) ([]Change, *cmd.XbeeError) {
+	if err := vms.Settle(ctx); err != nil {
+		return nil, err
+	}
+	existing, _ := vms.Existing()
+	var mu sync.Mutex
+	var pending []Change
+	var list []util.Executor
+	for _, vm := range existing {
+		vm := vm
+		list = append(list, func(ctx context.Context) *cmd.XbeeError {
+			changes, err := vm.Reconcile(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			pending = append(pending, changes...)
+			return err
+		})
+	}
+	err := util.Execute(ctx, list...)
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].Host < pending[j].Host })
+	return pending, err
+}
@@ -0,0 +1,62 @@
+package virtualbox
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReconcileStoppedVm(t *testing.T) {
+	useFakeVbox(t)
+	ctx := context.Background()
+	vm := newTestVm(t, ctx, "a")
+	volume := addTestVolume(t, vm, "data")
+	vm.Host.Specification.Memory = 2048
+	pending, err := (Vms{vm}).Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("changes left on a stopped vm : %v", pending)
+	}
+	if memory := vm.info.Machine().Memory; memory != 2048 {
+		t.Errorf("memory %d after reconcile, expected 2048", memory)
+	}
+	if nic := vm.info.Machine().NIC(2); nic == nil || nic.Attachment != "intnet" || nic.Network != DefaultNet() {
+		t.Errorf("nic2 %+v after reconcile, expected intnet %s", nic, DefaultNet())
+	}
+	if _, ok := vm.info.AttachedVolumes()[volume.File().String()]; !ok {
+		t.Errorf("volume not attached after reconcile : %v", vm.info.AttachedVolumes())
+	}
+	if changes := vm.Plan(); len(changes) != 0 {
+		t.Errorf("changes left after reconcile : %v", changes)
+	}
+}
+
+func TestReconcileRunningVm(t *testing.T) {
+	useFakeVbox(t)
+	ctx := context.Background()
+	vm := newTestVm(t, ctx, "a", "18080:80")
+	if err := vm.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	vm.Ports = []string{"18443:443"}
+	vm.Host.Specification.Cpus = 4
+	pending, err := (Vms{vm}).Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cpus and network adapters need a stopped vm, NAT rules are changed live
+	if len(pending) != 2 {
+		t.Errorf("pending changes : %v, expected cpus and network adapters", pending)
+	}
+	rules := vm.info.NATRules()
+	if _, ok := rules["PRODUCT-80"]; ok {
+		t.Errorf("NAT rule PRODUCT-80 left : %v", rules)
+	}
+	if port := rules["PRODUCT-443"]; port != "18443" {
+		t.Errorf("PRODUCT-443 NAT rule exposes host port %q, expected 18443", port)
+	}
+	if cpus := vm.info.Machine().CPUs; cpus != 2 {
+		t.Errorf("cpus %d changed on a running vm", cpus)
+	}
+}
@@ -0,0 +1,465 @@
+package virtualbox
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/iodasolutions/virtualbox/properties"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/newfs"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote runs VBoxManage on another machine with the ssh client of this one, as docker does for ssh:// hosts.
+// It is enabled with XBEE_VBOX_REMOTE=[user@]host[:port] (current user and port 22 by default); ssh must log in
+// without prompting, with a key of ~/.ssh or of the ssh agent. Commands share one connection, except on Windows.
+//
+// The local xbee folder (cache, exports, volumes) is mirrored under the home directory of the remote user.
+// NAT rules listen on every interface of the remote host, so that forwarded ports are reachable from here.
+type Remote struct {
+	Host string
+	Port string
+	User string
+	// VBoxManage is the executable run on the remote host.
+	VBoxManage string
+
+	mu     sync.Mutex
+	home   string
+	upload sync.Mutex // VMs started in parallel upload the same files
+}
+
+// XBEE_VBOX_REMOTE is read on first use of VBoxManage, system properties included, so that a malformed value is
+// returned by this first call instead of failing when the package loads.
+func init() {
+	if os.Getenv(envRemote) != "" {
+		properties.SetSystemPropertiesSource(func() (string, error) {
+			return currentRunner().Run(context.Background(), "list", "systemproperties")
+		})
+	}
+}
+
+func runnerFromEnv() Runner {
+	spec := os.Getenv(envRemote)
+	if spec == "" {
+		return execRunner{}
+	}
+	remote, err := ParseRemote(spec)
+	if err != nil {
+		return failingRunner{err: err}
+	}
+	return remote
+}
+
+// ParseRemote reads [user@]host[:port].
+func ParseRemote(spec string) (*Remote, *cmd.XbeeError) {
+	result := &Remote{Port: "22", VBoxManage: "VBoxManage"}
+	hostPort := spec
+	if index := strings.LastIndex(spec, "@"); index != -1 {
+		result.User, hostPort = spec[:index], spec[index+1:]
+	}
+	result.Host = hostPort
+	if index := strings.LastIndex(hostPort, ":"); index != -1 {
+		result.Host, result.Port = hostPort[:index], hostPort[index+1:]
+		if _, err := strconv.Atoi(result.Port); err != nil {
+			return nil, cmd.Error("invalid remote virtualbox host %s : port %s is not a number", spec, result.Port)
+		}
+	}
+	if result.Host == "" {
+		return nil, cmd.Error("invalid remote virtualbox host %s : expected [user@]host[:port]", spec)
+	}
+	if result.User == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, cmd.Error("invalid remote virtualbox host %s : no user given and current user is unknown : %v", spec, err)
+		}
+		result.User = current.Username
+	}
+	return result, nil
+}
+
+func (r *Remote) String() string {
+	return fmt.Sprintf("%s@%s:%s", r.User, r.Host, r.Port)
+}
+
+// RemoteExitError is returned when a command exits with a non zero status on the remote host.
+type RemoteExitError struct {
+	Host   string
+	Status int
+}
+
+func (e *RemoteExitError) Error() string {
+	return fmt.Sprintf("exit status %d on %s", e.Status, e.Host)
+}
+
+func (e *RemoteExitError) ExitCode() int {
+	return e.Status
+}
+
+// Run implements Runner. The ssh session is closed when ctx is done.
+func (r *Remote) Run(ctx context.Context, args ...string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	out, status, err := r.shell(ctx, shellJoin(append([]string{r.VBoxManage}, args...)), nil)
+	if err != nil {
+		return out, err
+	}
+	if status != 0 {
+		return out, &RemoteExitError{Host: r.Host, Status: status}
+	}
+	return out, nil
+}
+
+// sshCommand runs command on the remote host. ssh fails instead of prompting for a password or a host key.
+func (r *Remote) sshCommand(ctx context.Context, command string) *exec.Cmd {
+	args := []string{"-p", r.Port, "-o", "BatchMode=yes"}
+	if runtime.GOOS != "windows" {
+		// a master connection is kept a minute after the last command
+		args = append(args, "-o", "ControlMaster=auto", "-o", "ControlPersist=60s",
+			"-o", "ControlPath="+filepath.Join(os.TempDir(), "xbee-vbox-%C"))
+	}
+	c := exec.CommandContext(ctx, sshPath, append(args, r.User+"@"+r.Host, command)...)
+	// once ssh is killed, output is not waited for
+	c.WaitDelay = time.Second
+	return c
+}
+
+// sshPath is the ssh client, replaced in tests.
+var sshPath = "ssh"
+
+const exitMarker = "__xbee_exit="
+
+// shell runs a shell command on the remote host, with stdin as input if not nil, and returns its combined output and
+// exit status. The status is echoed after the output: a missing status means that ssh itself failed.
+func (r *Remote) shell(ctx context.Context, command string, stdin io.Reader) (string, int, *cmd.XbeeError) {
+	c := r.sshCommand(ctx, fmt.Sprintf("{ %s ; } 2>&1; echo %s$?", command, exitMarker))
+	var stdout, stderr bytes.Buffer
+	c.Stdin, c.Stdout, c.Stderr = stdin, &stdout, &stderr
+	err := c.Run()
+	out := stdout.String()
+	if ctx.Err() != nil {
+		return out, -1, cmd.Error("[%s] on %s interrupted : %v", command, r, ctx.Err())
+	}
+	index := strings.LastIndex(out, exitMarker)
+	if index == -1 {
+		return out, -1, cmd.Error("cannot run [%s] on %s : %v %s", command, r, err, strings.TrimSpace(stderr.String()))
+	}
+	status, err2 := strconv.Atoi(strings.TrimSpace(out[index+len(exitMarker):]))
+	if err2 != nil {
+		return out, -1, cmd.Error("unexpected output of [%s] on %s : %s", command, r, out)
+	}
+	return out[:index], status, nil
+}
+
+// exec runs a shell command on the remote host and fails if its exit status is not 0.
+func (r *Remote) exec(command string) (string, *cmd.XbeeError) {
+	return r.execInput(context.Background(), command, nil)
+}
+
+func (r *Remote) execInput(ctx context.Context, command string, stdin io.Reader) (string, *cmd.XbeeError) {
+	out, status, err := r.shell(ctx, command, stdin)
+	if err != nil {
+		return out, err
+	}
+	if status != 0 {
+		return out, cmd.Error("command [%s] failed on %s with exit status %d : %s", command, r, status, strings.TrimSpace(out))
+	}
+	return out, nil
+}
+
+func (r *Remote) Address() string {
+	return r.Host
+}
+
+func (r *Remote) NATHostIP() string {
+	return ""
+}
+
+func (r *Remote) homeDir() (string, *cmd.XbeeError) {
+	r.mu.Lock()
+	home := r.home
+	r.mu.Unlock()
+	if home != "" {
+		return home, nil
+	}
+	out, err := r.exec(`printf %s "$HOME"`)
+	if err != nil {
+		return "", cmd.Error("cannot find home directory of %s : %v", r, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.home = strings.TrimSpace(out)
+	return r.home, nil
+}
+
+// Path maps the local xbee folder to the folder of the same name in the remote home. Other paths are kept as is.
+func (r *Remote) Path(local string) (string, *cmd.XbeeError) {
+	root := newfs.GlobalXbeeFolder().String()
+	rel, err := filepath.Rel(root, local)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(local), nil
+	}
+	home, err2 := r.homeDir()
+	if err2 != nil {
+		return "", err2
+	}
+	return path.Join(home, filepath.Base(root), filepath.ToSlash(rel)), nil
+}
+
+func (r *Remote) Exists(p string) bool {
+	_, status, err := r.shell(context.Background(), "test -e "+shellQuote(p), nil)
+	return err == nil && status == 0
+}
+
+func (r *Remote) MkdirAll(p string) *cmd.XbeeError {
+	_, err := r.exec("mkdir -p " + shellQuote(p))
+	return err
+}
+
+// WriteFile sends data on the input of the ssh session.
+func (r *Remote) WriteFile(p string, data []byte) *cmd.XbeeError {
+	tmp := shellQuote(p + ".tmp")
+	_, err := r.execInput(context.Background(), fmt.Sprintf("mkdir -p %s && cat > %s && mv -f %s %s",
+		shellQuote(path.Dir(p)), tmp, tmp, shellQuote(p)), bytes.NewReader(data))
+	return err
+}
+
+func (r *Remote) Rename(from string, to string) *cmd.XbeeError {
+	_, err := r.exec(fmt.Sprintf("mkdir -p %s && mv -f %s %s", shellQuote(path.Dir(to)), shellQuote(from), shellQuote(to)))
+	return err
+}
+
+func (r *Remote) RemoveAll(p string) *cmd.XbeeError {
+	_, err := r.exec("rm -rf " + shellQuote(p))
+	return err
+}
+
+func (r *Remote) Untar(archive string, dir string) *cmd.XbeeError {
+	_, err := r.exec(fmt.Sprintf("mkdir -p %s && tar -xf %s -C %s", shellQuote(dir), shellQuote(archive), shellQuote(dir)))
+	return err
+}
+
+func (r *Remote) FilesEndingWith(dir string, suffix string) ([]string, *cmd.XbeeError) {
+	out, err := r.exec(fmt.Sprintf("find %s -maxdepth 1 -type f -name %s", shellQuote(dir), shellQuote("*"+suffix)))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result = append(result, line)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (r *Remote) Dirs(dir string) ([]string, *cmd.XbeeError) {
+	out, err := r.exec(fmt.Sprintf("if [ -d %[1]s ]; then find %[1]s -mindepth 1 -maxdepth 1 -type d; fi", shellQuote(dir)))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result = append(result, line)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (r *Remote) LastModified(dir string) (time.Time, *cmd.XbeeError) {
+	out, err := r.exec(fmt.Sprintf("find %s -maxdepth 1 -printf '%%T@\\n' | sort -n | tail -n 1", shellQuote(dir)))
+	if err != nil {
+		return time.Time{}, err
+	}
+	seconds, _, _ := strings.Cut(strings.TrimSpace(out), ".")
+	unix, err2 := strconv.ParseInt(seconds, 10, 64)
+	if err2 != nil {
+		return time.Time{}, cmd.Error("cannot read folder %s on %s : %s", dir, r, strings.TrimSpace(out))
+	}
+	return time.Unix(unix, 0), nil
+}
+
+func (r *Remote) Tail(p string, lines int) (string, *cmd.XbeeError) {
+	read := "cat " + shellQuote(p)
+	if lines > 0 {
+		read = fmt.Sprintf("tail -n %d %s", lines, shellQuote(p))
+	}
+	return r.exec(fmt.Sprintf("if [ -f %s ]; then %s; fi", shellQuote(p), read))
+}
+
+// Upload sends files whose size or modification time differ from the ones on the remote host, so that files are
+// not read again on each start. They are streamed as a tar archive, which keeps permissions (the xbee binary is
+// copied to the guest from there) and modification times.
+func (r *Remote) Upload(ctx context.Context, local string) (string, *cmd.XbeeError) {
+	target, err := r.Path(local)
+	if err != nil {
+		return "", err
+	}
+	if DryRun() {
+		log2.Infof("[dry-run] would upload %s to %s on %s", local, target, r.Host)
+		return target, nil
+	}
+	r.upload.Lock()
+	defer r.upload.Unlock()
+	out, err := r.exec(fmt.Sprintf("if [ -d %[1]s ]; then find %[1]s -type f -printf '%%s %%T@ %%P\\n'; fi", shellQuote(target)))
+	if err != nil {
+		return "", err
+	}
+	remote := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		seconds, _, _ := strings.Cut(fields[1], ".")
+		remote[fields[2]] = fields[0] + " " + seconds
+	}
+	var changed []string
+	walkErr := filepath.WalkDir(local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		if remote[filepath.ToSlash(rel)] != fmt.Sprintf("%d %d", info.Size(), info.ModTime().Unix()) {
+			changed = append(changed, rel)
+		}
+		return nil
+	})
+	if walkErr != nil && !os.IsNotExist(walkErr) {
+		return "", cmd.Error("cannot upload %s to %s : %v", local, r.Host, walkErr)
+	}
+	if len(changed) == 0 {
+		return target, nil
+	}
+	log2.Infof("Upload %d files of %s to %s", len(changed), local, r.Host)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTar(writer, local, changed))
+	}()
+	_, err = r.execInput(ctx, fmt.Sprintf("mkdir -p %[1]s && tar -xpf - -C %[1]s", shellQuote(target)), reader)
+	// unblocks writeTar if ssh stopped reading
+	reader.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return "", cmd.Error("cannot upload %s to %s : %v", local, r.Host, err)
+	}
+	return target, nil
+}
+
+// writeTar writes files of dir, given relative to it, as a tar archive.
+func writeTar(w io.Writer, dir string, files []string) error {
+	tw := tar.NewWriter(w)
+	for _, rel := range files {
+		if err := writeTarEntry(tw, filepath.Join(dir, rel), filepath.ToSlash(rel)); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, p string, name string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.ModTime = info.ModTime().Truncate(time.Second)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, header.Size)
+	return err
+}
+
+func (r *Remote) Download(ctx context.Context, rawUrl string) (string, *cmd.XbeeError) {
+	target, err := r.Path(newfs.CachedFileForUrl(rawUrl).String())
+	if err != nil {
+		return "", err
+	}
+	if r.Exists(target) {
+		log2.Debugf("Found %s in xbee cache of %s", path.Base(target), r.Host)
+		return target, nil
+	}
+	if DryRun() {
+		log2.Infof("[dry-run] would download %s to %s on %s", rawUrl, target, r.Host)
+		return target, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return target, cmd.Error("download of %s cancelled : %v", rawUrl, err)
+	}
+	log2.Infof("Download %s on %s...", rawUrl, r.Host)
+	tmp := shellQuote(target + ".tmp")
+	command := fmt.Sprintf("mkdir -p %[1]s && (curl -fsSL -o %[2]s %[3]s || wget -q -O %[2]s %[3]s) && mv -f %[2]s %[4]s",
+		shellQuote(path.Dir(target)), tmp, shellQuote(rawUrl), shellQuote(target))
+	if _, err := r.exec(command); err != nil {
+		return target, err
+	}
+	log2.Infof("Resource %s Transferred on %s", path.Base(target), r.Host)
+	return target, nil
+}
+
+// ExtractVmdk follows extractVmdk, with files on the remote host.
+func (r *Remote) ExtractVmdk(p string) (string, *cmd.XbeeError) {
+	if strings.HasSuffix(p, ".vmdk") {
+		return p, nil
+	}
+	name := path.Base(p)
+	if index := strings.LastIndex(name, "."); index != -1 {
+		result := path.Join(path.Dir(p), name[:index]+".vmdk")
+		if r.Exists(result) {
+			return result, nil
+		}
+	}
+	if !strings.HasSuffix(p, ".box") {
+		return "", cmd.Error("unrecognized extension in file : %s", p)
+	}
+	targetPath := strings.TrimSuffix(p, ".box") + ".vmdk"
+	extractDir := strings.TrimSuffix(p, ".box") + ".extract"
+	defer r.RemoveAll(extractDir)
+	if err := r.Untar(p, extractDir); err != nil {
+		return "", cmd.Error("cannot extract %s: %v", p, err)
+	}
+	children, err := r.FilesEndingWith(extractDir, ".vmdk")
+	if err != nil {
+		return "", err
+	}
+	if len(children) != 1 {
+		return "", cmd.Error("file %s is a tar file, but it contains no component with extension vmdk", p)
+	}
+	if err := r.Rename(children[0], targetPath); err != nil {
+		return "", err
+	}
+	return targetPath, nil
+}
@@ -0,0 +1,67 @@
+package virtualbox
+
+import (
+	"strings"
+	"time"
+)
+
+// RetryPolicy tells how a VBoxManage command failing with a transient error (machine locked by another session...) is retried.
+type RetryPolicy struct {
+	MaxAttempts  int // 1 disables retries
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+}
+
+// DefaultRetryPolicy can be tuned with XBEE_VBOX_RETRY_ATTEMPTS, XBEE_VBOX_RETRY_DELAY and XBEE_VBOX_RETRY_MAX_DELAY.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  envInt(envRetryAttempts, 6),
+		InitialDelay: envDuration(envRetryDelay, 500*time.Millisecond),
+		MaxDelay:     envDuration(envRetryMaxDelay, 10*time.Second),
+		Multiplier:   2,
+	}
+}
+
+func (p RetryPolicy) nextDelay(delay time.Duration) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	next := time.Duration(float64(delay) * multiplier)
+	if p.MaxDelay > 0 && next > p.MaxDelay {
+		next = p.MaxDelay
+	}
+	return next
+}
+
+var transientMarkers = []string{
+	"Failed to get a console object from the direct session",
+	"The session is not locked",
+	"is being used by another process",
+}
+
+// retrySafe tells whether a VBoxManage command may run again after a failure: it only queries virtualbox, or gives
+// the same result when applied twice. Commands creating something (createvm, clonemedium, snapshot take...) may have
+// partly succeeded, their retry would fail with "already exists" and hide the first error.
+func retrySafe(args []string) bool {
+	if readOnly(args) {
+		return true
+	}
+	switch args[0] {
+	case "modifyvm", "modifymedium", "setextradata", "storageattach":
+		return true
+	}
+	return false
+}
+
+// Retryable tells whether running the same command again may succeed.
+func (e *VboxError) Retryable() bool {
+	if e == nil {
+		return false
+	}
+	if e.Kind == KindLocked || e.Code == "NS_ERROR_CALL_FAILED" {
+		return true
+	}
+	return containsAny(strings.Join(e.Messages, "\n"), transientMarkers)
+}
@@ -0,0 +1,89 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/newfs"
+	"strings"
+)
+
+// rollback records creation steps of a VM, so that a failed creation undoes exactly what was done.
+// Otherwise the next Up would find an existing but down VM and start it half configured.
+type rollback struct {
+	vm    *Vm
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	description string
+	undo        func(ctx context.Context) *cmd.XbeeError
+}
+
+func (r *rollback) add(description string, undo func(ctx context.Context) *cmd.XbeeError) {
+	r.steps = append(r.steps, rollbackStep{description: description, undo: undo})
+}
+
+// run undoes steps in reverse order, then returns err with what could not be undone.
+// Its context is not the one of the creation, which may be the cause of the failure.
+func (r *rollback) run(err *cmd.XbeeError) *cmd.XbeeError {
+	if len(r.steps) == 0 {
+		return err
+	}
+	log2.Warnf("%s : creation failed, undo it...", r.vm.HostName)
+	ctx := context.Background()
+	var failures []string
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		log2.Infof("%s : undo %s", r.vm.HostName, step.description)
+		if err2 := step.undo(ctx); err2 != nil {
+			log2.Warnf("%s : cannot undo %s : %v", r.vm.HostName, step.description, err2)
+			failures = append(failures, fmt.Sprintf("%s (%v)", step.description, strings.TrimSpace(err2.Error())))
+		}
+	}
+	r.steps = nil
+	if len(failures) > 0 {
+		return cmd.Error("%s : creation failed : %v\nand could not be completely undone, left : %s", r.vm.HostName, strings.TrimSpace(err.Error()), strings.Join(failures, ", "))
+	}
+	return cmd.Error("%s : creation failed and was undone : %v", r.vm.HostName, strings.TrimSpace(err.Error()))
+}
+
+// undoFolder removes the folder of the VM, unless it already exists: it is not ours.
+func (r *rollback) undoFolder() {
+	hv := currentHypervisor()
+	folder := r.vm.Folder().String()
+	if hv.Exists(folder) {
+		return
+	}
+	r.add("vm folder "+folder, func(ctx context.Context) *cmd.XbeeError {
+		if DryRun() {
+			log2.Infof("[dry-run] %s : would delete folder %s", r.vm.HostName, folder)
+			return nil
+		}
+		return hv.RemoveAll(folder)
+	})
+}
+
+// undoRegistration powers off and unregisters the VM. Volumes are detached first, they must survive it.
+func (r *rollback) undoRegistration() {
+	vm := r.vm
+	r.add("registration of vm "+vm.Name(), func(ctx context.Context) *cmd.XbeeError {
+		if err := vm.Vbox().PowerOff(ctx); err != nil {
+			return err
+		}
+		if err := vm.refresh(ctx); err != nil {
+			return err
+		}
+		if err := vm.EnsureVolumesDetached(ctx); err != nil {
+			return err
+		}
+		return vm.Vbox().Unregister(ctx)
+	})
+}
+
+func (r *rollback) undoSystemDisk(disk string) {
+	r.add("system disk "+disk, func(ctx context.Context) *cmd.XbeeError {
+		return r.vm.Vbox().RemoveMedium(ctx, newfs.NewFile(disk))
+	})
+}
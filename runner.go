@@ -0,0 +1,108 @@
+package virtualbox
+
+import (
+	"context"
+	"github.com/iodasolutions/virtualbox/properties"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"os/exec"
+	"sync"
+)
+
+// Runner executes one VBoxManage invocation and returns its combined output.
+// A non nil error means the command did not succeed; the output is still returned
+// since VBoxManage reports its errors on it.
+type Runner interface {
+	Run(ctx context.Context, args ...string) (string, error)
+}
+
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, properties.VboxPath(), args...).CombinedOutput()
+	return string(out), err
+}
+
+var current = struct {
+	runner  Runner
+	retry   *RetryPolicy
+	caps    *Capabilities
+	capsErr *cmd.XbeeError
+	sync.RWMutex
+}{}
+
+// SetRunner replaces the runner used by every Vbox, including the lookup of virtualbox system properties.
+// It is meant to be called once, before any other call in this package (for example with a fakevbox.VBoxManage in CI).
+func SetRunner(r Runner) {
+	current.Lock()
+	defer current.Unlock()
+	current.runner = r
+	current.caps, current.capsErr = nil, nil
+	properties.SetSystemPropertiesSource(func() (string, error) {
+		return r.Run(context.Background(), "list", "systemproperties")
+	})
+}
+
+// SetRetryPolicy replaces DefaultRetryPolicy for every Vbox created afterwards.
+func SetRetryPolicy(p RetryPolicy) {
+	current.Lock()
+	defer current.Unlock()
+	current.retry = &p
+}
+
+func currentRetryPolicy() RetryPolicy {
+	current.RLock()
+	defer current.RUnlock()
+	if current.retry != nil {
+		return *current.retry
+	}
+	return DefaultRetryPolicy()
+}
+
+// CurrentCapabilities returns capabilities of the VirtualBox version behind the current runner.
+// VBoxManage --version runs once, without the lock held; its failure is kept until SetRunner too.
+func CurrentCapabilities() (*Capabilities, *cmd.XbeeError) {
+	runner := currentRunner()
+	current.RLock()
+	caps, capsErr := current.caps, current.capsErr
+	current.RUnlock()
+	if caps != nil || capsErr != nil {
+		return caps, capsErr
+	}
+	version, err := versionFrom(runner)
+	if err == nil {
+		caps = CapabilitiesFor(ParseVersion(version))
+	} else {
+		err = cmd.Error("cannot find the version of VirtualBox : %v", err)
+	}
+	current.Lock()
+	defer current.Unlock()
+	if current.runner == runner && current.caps == nil && current.capsErr == nil {
+		current.caps, current.capsErr = caps, err
+	}
+	return caps, err
+}
+
+// currentRunner returns the runner given to SetRunner, or the one of XBEE_VBOX_REMOTE on first use.
+func currentRunner() Runner {
+	current.RLock()
+	r := current.runner
+	current.RUnlock()
+	if r != nil {
+		return r
+	}
+	current.Lock()
+	defer current.Unlock()
+	if current.runner == nil {
+		current.runner = runnerFromEnv()
+	}
+	return current.runner
+}
+
+// failingRunner fails every command with err, XBEE_VBOX_REMOTE being invalid.
+type failingRunner struct {
+	err *cmd.XbeeError
+}
+
+func (r failingRunner) Run(ctx context.Context, args ...string) (string, error) {
+	return "", r.err
+}
@@ -0,0 +1,302 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/log2"
+	"github.com/iodasolutions/xbee-common/util"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tagSnapshotTime prefixes the extradata key holding the creation time of a snapshot, followed by its UUID.
+// showvminfo does not give it.
+const tagSnapshotTime = "xbee/SnapshotTime/"
+
+// VmSnapshot is a snapshot of a VM.
+type VmSnapshot struct {
+	Name        string
+	UUID        string
+	Description string
+	Parent      string    // name of the parent snapshot, empty for the root one
+	CreatedAt   time.Time // zero for snapshots not taken by xbee
+	Current     bool      // the current state of the VM derives from this snapshot
+}
+
+var snapshotTakenRegexp = regexp.MustCompile(`UUID: ([0-9a-fA-F-]+)`)
+
+// TakeSnapshot takes a snapshot of the VM, running or not.
+func (vbox *Vbox) TakeSnapshot(ctx context.Context, name string, description string) *cmd.XbeeError {
+	args := []string{"snapshot", vbox.name, "take", name}
+	if description != "" {
+		args = append(args, "--description", description)
+	}
+	out, err := vbox.execute(ctx, args...)
+	if err != nil {
+		return err
+	}
+	if m := snapshotTakenRegexp.FindStringSubmatch(out); m != nil {
+		return vbox.SetExtraData(ctx, tagSnapshotTime+m[1], time.Now().UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RestoreSnapshot requires the VM to be powered off or saved.
+func (vbox *Vbox) RestoreSnapshot(ctx context.Context, name string) *cmd.XbeeError {
+	_, err := vbox.execute(ctx, "snapshot", vbox.name, "restore", name)
+	return err
+}
+
+func (vbox *Vbox) DeleteSnapshot(ctx context.Context, snapshot VmSnapshot) *cmd.XbeeError {
+	if _, err := vbox.execute(ctx, "snapshot", vbox.name, "delete", snapshot.UUID); err != nil {
+		return err
+	}
+	return vbox.SetExtraData(ctx, tagSnapshotTime+snapshot.UUID, "")
+}
+
+// Snapshots returns snapshots of the VM, parents before children.
+func (vbox *Vbox) Snapshots(ctx context.Context) ([]VmSnapshot, *cmd.XbeeError) {
+	machine, vErr := ShowMachineInfo(ctx, vbox.name)
+	if vErr != nil {
+		return nil, vErr.XbeeError()
+	}
+	extra, err := vbox.ExtraData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, s := range machine.Snapshots {
+		names[s.UUID] = s.Name
+	}
+	var result []VmSnapshot
+	for _, s := range machine.Snapshots {
+		snapshot := VmSnapshot{
+			Name:        s.Name,
+			UUID:        s.UUID,
+			Description: s.Description,
+			Parent:      names[s.Parent],
+			Current:     s.Name == machine.CurrentSnapshot,
+		}
+		snapshot.CreatedAt, _ = time.Parse(time.RFC3339, extra[tagSnapshotTime+s.UUID])
+		result = append(result, snapshot)
+	}
+	return result, nil
+}
+
+func (vm *Vm) snapshot(ctx context.Context, name string) (*VmSnapshot, *cmd.XbeeError) {
+	snapshots, err := vm.Vbox().Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range snapshots {
+		if snapshots[i].Name == name {
+			return &snapshots[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// restoreSnapshot brings the VM back to the snapshot, powered off: what runs in it is lost.
+// Seed iso, guest additions and NAT rules are cleaned as after a down, so that Start configures the VM again.
+func (vm *Vm) restoreSnapshot(ctx context.Context, name string) *cmd.XbeeError {
+	if err := vm.ensureOff(ctx); err != nil {
+		return err
+	}
+	log2.Infof("%s : restore snapshot %s...", vm.HostName, name)
+	vb := vm.Vbox()
+	if err := vb.RestoreSnapshot(ctx, name); err != nil {
+		return err
+	}
+	if err := vm.refresh(ctx); err != nil {
+		return err
+	}
+	// a snapshot taken while running is restored with its saved state, which Start would resume without reconfiguration
+	if state := vm.info.MachineState(); state == MachineSaved || state == MachineAbortedSaved {
+		if err := vb.DiscardState(ctx); err != nil {
+			return err
+		}
+		if err := vm.refresh(ctx); err != nil {
+			return err
+		}
+	}
+	return vm.AfterDown(ctx)
+}
+
+func (vm *Vm) deleteSnapshot(ctx context.Context, name string) *cmd.XbeeError {
+	s, err := vm.snapshot(ctx, name)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		log2.Infof("%s : snapshot %s already does not exist", vm.HostName, name)
+		return nil
+	}
+	log2.Infof("%s : delete snapshot %s...", vm.HostName, name)
+	return vm.Vbox().DeleteSnapshot(ctx, *s)
+}
+
+// Select returns VMs of the given hosts, every VM when none is given.
+func (vms Vms) Select(hostNames ...string) (Vms, *cmd.XbeeError) {
+	if len(hostNames) == 0 {
+		return vms, nil
+	}
+	byName := map[string]*Vm{}
+	for _, vm := range vms {
+		byName[vm.HostName] = vm
+	}
+	var result Vms
+	for _, name := range hostNames {
+		vm, ok := byName[name]
+		if !ok {
+			return nil, cmd.Error("host %s is not declared", name)
+		}
+		result = append(result, vm)
+	}
+	return result, nil
+}
+
+// TakeSnapshot snapshots VMs together: when several are running, they are paused until every snapshot is taken, so that
+// the set is consistent. A single running VM is not paused: VirtualBox snapshots it live, with its saved state.
+// If one snapshot fails, the ones already taken are deleted: a snapshot missing on some VMs could not be restored.
+func (vms Vms) TakeSnapshot(ctx context.Context, name string, description string) (err *cmd.XbeeError) {
+	if err = vms.Settle(ctx); err != nil {
+		return
+	}
+	existing, notExisting := vms.Existing()
+	if len(notExisting) > 0 {
+		return cmd.Error("hosts %v do not exist, no snapshot taken", notExisting.Names())
+	}
+	for _, vm := range existing {
+		if s, err := vm.snapshot(ctx, name); err != nil {
+			return err
+		} else if s != nil {
+			return cmd.Error("host %s already has a snapshot %s, no snapshot taken", vm.HostName, name)
+		}
+	}
+	var running Vms
+	for _, vm := range existing {
+		if vm.info.MachineState() == MachineRunning {
+			running = append(running, vm)
+		}
+	}
+	if len(running) > 1 {
+		var paused Vms
+		defer func() {
+			// ctx may be the cause of the failure, VMs must run again anyway
+			ctx, cancel := context.WithTimeout(context.Background(), snapshotCleanupTimeout)
+			defer cancel()
+			for _, vm := range paused {
+				if err2 := vm.Vbox().Resume(ctx); err2 != nil {
+					if err != nil {
+						log2.Errorf("%s : %v", vm.HostName, err2)
+					} else {
+						err = err2
+					}
+				}
+			}
+		}()
+		for _, vm := range running {
+			if err = vm.Vbox().Pause(ctx); err != nil {
+				return
+			}
+			paused = append(paused, vm)
+		}
+	}
+	// failures are collected, so that every snapshot is finished before the ones taken are deleted
+	var mu sync.Mutex
+	var failures []string
+	var list []util.Executor
+	for _, vm := range existing {
+		vm := vm
+		list = append(list, func(ctx context.Context) *cmd.XbeeError {
+			log2.Infof("%s : take snapshot %s...", vm.HostName, name)
+			if err := vm.Vbox().TakeSnapshot(ctx, name, description); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				failures = append(failures, fmt.Sprintf("%s : %s", vm.HostName, strings.TrimSpace(err.Error())))
+			}
+			return nil
+		})
+	}
+	err = util.Execute(ctx, list...)
+	if err == nil && len(failures) > 0 {
+		sort.Strings(failures)
+		err = cmd.Error("snapshot %s failed :\n%s", name, strings.Join(failures, "\n"))
+	}
+	if err != nil {
+		existing.deleteTakenSnapshot(name)
+	}
+	return
+}
+
+// snapshotCleanupTimeout bounds what is done after a failed snapshot, with a context of its own.
+const snapshotCleanupTimeout = 2 * time.Minute
+
+// deleteTakenSnapshot deletes snapshot name of VMs, where it was taken before a failure.
+func (vms Vms) deleteTakenSnapshot(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotCleanupTimeout)
+	defer cancel()
+	for _, vm := range vms {
+		if err := vm.deleteSnapshot(ctx, name); err != nil {
+			log2.Errorf("%s : cannot delete snapshot %s : %v", vm.HostName, name, err)
+		}
+	}
+}
+
+// RestoreSnapshot restores VMs to the snapshot, then starts them again as Up does. Every VM must have it.
+func (vms Vms) RestoreSnapshot(ctx context.Context, name string) *cmd.XbeeError {
+	if err := vms.Settle(ctx); err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if vm.NotExisting() {
+			return cmd.Error("host %s does not exist, nothing restored", vm.HostName)
+		}
+		if s, err := vm.snapshot(ctx, name); err != nil {
+			return err
+		} else if s == nil {
+			return cmd.Error("host %s has no snapshot %s, nothing restored", vm.HostName, name)
+		}
+	}
+	var list []util.Executor
+	for _, vm := range vms {
+		vm := vm
+		list = append(list, func(ctx context.Context) *cmd.XbeeError {
+			return vm.restoreSnapshot(ctx, name)
+		})
+	}
+	if err := util.Execute(ctx, list...); err != nil {
+		return err
+	}
+	return vms.Up(ctx)
+}
+
+func (vms Vms) DeleteSnapshot(ctx context.Context, name string) *cmd.XbeeError {
+	existing, _ := vms.Existing()
+	var list []util.Executor
+	for _, vm := range existing {
+		vm := vm
+		list = append(list, func(ctx context.Context) *cmd.XbeeError {
+			return vm.deleteSnapshot(ctx, name)
+		})
+	}
+	return util.Execute(ctx, list...)
+}
+
+// Snapshots returns snapshots by host name.
+func (vms Vms) Snapshots(ctx context.Context) (map[string][]VmSnapshot, *cmd.XbeeError) {
+	result := map[string][]VmSnapshot{}
+	existing, _ := vms.Existing()
+	for _, vm := range existing {
+		snapshots, err := vm.Vbox().Snapshots(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result[vm.HostName] = snapshots
+	}
+	return result, nil
+}
@@ -0,0 +1,121 @@
+package virtualbox
+
+import (
+	"context"
+	"github.com/iodasolutions/virtualbox/fakevbox"
+	"testing"
+)
+
+// failingSnapshot fails snapshot take of one VM.
+type failingSnapshot struct {
+	*fakevbox.VBoxManage
+	vm string
+}
+
+func (r failingSnapshot) Run(ctx context.Context, args ...string) (string, error) {
+	if len(args) > 2 && args[0] == "snapshot" && args[1] == r.vm && args[2] == "take" {
+		return "", &fakevbox.ExitError{Code: 1}
+	}
+	return r.VBoxManage.Run(ctx, args...)
+}
+
+func startedTestVms(t *testing.T, ctx context.Context, hostNames ...string) (result Vms) {
+	t.Helper()
+	for _, hostName := range hostNames {
+		vm := newTestVm(t, ctx, hostName)
+		addTestVolume(t, vm, "data-"+hostName)
+		if err := vm.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, vm)
+	}
+	return
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	f := useFakeVbox(t)
+	ctx := context.Background()
+	vms := startedTestVms(t, ctx, "a", "b")
+	if err := vms.TakeSnapshot(ctx, "s1", "before deploy"); err != nil {
+		t.Fatal(err)
+	}
+	for _, vm := range vms {
+		if state := f.State(vm.Name()); state != "running" {
+			t.Errorf("%s : state after snapshot : %s, expected running", vm.HostName, state)
+		}
+		s, err := vm.snapshot(ctx, "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s == nil {
+			t.Fatalf("%s : no snapshot s1", vm.HostName)
+		}
+		if s.Description != "before deploy" || s.CreatedAt.IsZero() {
+			t.Errorf("%s : snapshot %+v, expected its description and creation time", vm.HostName, *s)
+		}
+		extra, err := vm.Vbox().ExtraData(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if extra[tagSnapshotTime+s.UUID] == "" {
+			t.Errorf("%s : no extradata %s", vm.HostName, tagSnapshotTime+s.UUID)
+		}
+	}
+	if err := vms.TakeSnapshot(ctx, "s1", ""); err == nil {
+		t.Error("a second snapshot s1 was taken")
+	}
+}
+
+func TestTakeSnapshotDeletesTakenOnFailure(t *testing.T) {
+	f := useFakeVbox(t)
+	ctx := context.Background()
+	vms := startedTestVms(t, ctx, "a", "b", "c")
+	SetRunner(failingSnapshot{VBoxManage: f, vm: vms[2].Name()})
+	if err := vms.TakeSnapshot(ctx, "s1", ""); err == nil {
+		t.Fatal("snapshot of c did not fail")
+	}
+	SetRunner(f)
+	snapshots, err := vms.Snapshots(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vm := range vms {
+		if len(snapshots[vm.HostName]) != 0 {
+			t.Errorf("%s : snapshots left : %+v", vm.HostName, snapshots[vm.HostName])
+		}
+		if state := f.State(vm.Name()); state != "running" {
+			t.Errorf("%s : state after failed snapshot : %s, expected running", vm.HostName, state)
+		}
+	}
+}
+
+func TestRestoreSnapshotLeavesVolumes(t *testing.T) {
+	f := useFakeVbox(t)
+	ctx := context.Background()
+	vms := startedTestVms(t, ctx, "a")
+	vm := vms[0]
+	volume := vm.volumes["data-a"]
+	if err := vms.TakeSnapshot(ctx, "s1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.restoreSnapshot(ctx, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if state := f.State(vm.Name()); state != "poweroff" {
+		t.Errorf("state after restore : %s, expected poweroff", state)
+	}
+	if rules := vm.info.NATRules(); len(rules) != 0 {
+		t.Errorf("NAT rules left after restore : %v", rules)
+	}
+	// a writethrough volume is not part of the snapshot : its current state stays attached
+	port, ok := vm.info.AttachedVolumes()[volume.File().String()]
+	if !ok || port != 1 {
+		t.Errorf("volume attached on port %d (%v) after restore, expected 1", port, ok)
+	}
+	if err := vms.DeleteSnapshot(ctx, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := vm.snapshot(ctx, "s1"); err != nil || s != nil {
+		t.Errorf("snapshot s1 after delete : %+v %v", s, err)
+	}
+}
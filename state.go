@@ -0,0 +1,218 @@
+package virtualbox
+
+import (
+	"context"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/constants"
+	"github.com/iodasolutions/xbee-common/log2"
+	"time"
+)
+
+// MachineState is the VMState of a VM, as printed by VBoxManage showvminfo --machinereadable.
+type MachineState string
+
+const (
+	MachineNotRegistered          MachineState = ""
+	MachinePoweroff               MachineState = "poweroff"
+	MachineAborted                MachineState = "aborted"
+	MachineTeleported             MachineState = "teleported"
+	MachineRunning                MachineState = "running"
+	MachinePaused                 MachineState = "paused"
+	MachineSaved                  MachineState = "saved"
+	MachineAbortedSaved           MachineState = "aborted-saved"
+	MachineStarting               MachineState = "starting"
+	MachineStopping               MachineState = "stopping"
+	MachineSaving                 MachineState = "saving"
+	MachineRestoring              MachineState = "restoring"
+	MachineSettingUp              MachineState = "settingup"
+	MachineSnapshotting           MachineState = "snapshotting"
+	MachineLiveSnapshotting       MachineState = "livesnapshotting"
+	MachineOnlineSnapshotting     MachineState = "onlinesnapshotting"
+	MachineRestoringSnapshot      MachineState = "restoringsnapshot"
+	MachineDeletingSnapshot       MachineState = "deletingsnapshot"
+	MachineDeletingSnapshotLive   MachineState = "deletingsnapshotlive"
+	MachineDeletingSnapshotPaused MachineState = "deletingsnapshotlivepaused"
+	MachineTeleporting            MachineState = "teleporting"
+	MachineTeleportingPaused      MachineState = "teleportingpausedvm"
+	MachineTeleportingIn          MachineState = "teleportingin"
+	MachineGuruMeditation         MachineState = "gurumeditation"
+	MachineStuck                  MachineState = "stuck"
+)
+
+// Off tells whether the VM is registered and not running, without saved state.
+func (s MachineState) Off() bool {
+	return s == MachinePoweroff || s == MachineAborted || s == MachineTeleported
+}
+
+// Suspended tells whether the VM can be resumed where it stopped: paused, or saved to disk.
+func (s MachineState) Suspended() bool {
+	return s == MachinePaused || s == MachineSaved || s == MachineAbortedSaved
+}
+
+// Stuck tells whether the VM crashed and can only be powered off.
+func (s MachineState) Stuck() bool {
+	return s == MachineGuruMeditation || s == MachineStuck
+}
+
+// Transitional tells whether VirtualBox is moving the VM from a state to another. It must be waited.
+func (s MachineState) Transitional() bool {
+	return s != MachineNotRegistered && s != MachineRunning && !s.Off() && !s.Suspended() && !s.Stuck()
+}
+
+// ProviderState is the state reported to xbee: up, down and notexisting as for other providers,
+// the VirtualBox state otherwise (saved, paused, gurumeditation...).
+func (s MachineState) ProviderState() string {
+	switch {
+	case s == MachineNotRegistered:
+		return constants.State.NotExisting
+	case s == MachineRunning:
+		return constants.State.Up
+	case s.Off():
+		return constants.State.Down
+	}
+	return string(s)
+}
+
+// settle waits until the VM leaves transitional states, at most XBEE_VBOX_SETTLE_TIMEOUT (2m by default).
+func (vm *Vm) settle(ctx context.Context) *cmd.XbeeError {
+	state := vm.info.MachineState()
+	if !state.Transitional() {
+		return nil
+	}
+	if DryRun() {
+		log2.Infof("[dry-run] %s : would wait until state %s ends", vm.HostName, state)
+		return nil
+	}
+	log2.Infof("%s : vm is %s, wait until it settles...", vm.HostName, state)
+	timeout := envDuration(envSettleTimeout, 2*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return cmd.Error("%s : vm still %s after %v", vm.HostName, state, timeout)
+		case <-time.After(time.Second):
+			if err := vm.refresh(ctx); err != nil {
+				return err
+			}
+			if state = vm.info.MachineState(); !state.Transitional() {
+				log2.Infof("%s : vm is now %s", vm.HostName, state)
+				return nil
+			}
+		}
+	}
+}
+
+// ensureOff brings a VM in any state to poweroff, losing what runs in it: running, paused and stuck VMs
+// are powered off, the saved state is discarded.
+func (vm *Vm) ensureOff(ctx context.Context) *cmd.XbeeError {
+	if err := vm.settle(ctx); err != nil {
+		return err
+	}
+	state := vm.info.MachineState()
+	switch {
+	case state == MachineNotRegistered || state.Off():
+		return nil
+	case state == MachineSaved || state == MachineAbortedSaved:
+		log2.Warnf("%s : discard saved state", vm.HostName)
+		if err := vm.Vbox().DiscardState(ctx); err != nil {
+			return err
+		}
+	default:
+		if state.Stuck() {
+			log2.Warnf("%s : vm is %s, force power off", vm.HostName, state)
+		}
+		if err := vm.Vbox().PowerOff(ctx); err != nil {
+			return err
+		}
+	}
+	return vm.waitDown(ctx)
+}
+
+// stop brings an existing VM to poweroff between pre-stop and post-stop hooks.
+func (vm *Vm) stop(ctx context.Context) *cmd.XbeeError {
+	if err := vm.settle(ctx); err != nil {
+		return err
+	}
+	if state := vm.info.MachineState(); state == MachineNotRegistered || state.Off() {
+		return vm.ensureOff(ctx)
+	}
+	if err := vm.runHooks(ctx, HookPreStop); err != nil {
+		return err
+	}
+	if err := vm.shutdown(ctx); err != nil {
+		return err
+	}
+	return vm.runHooks(ctx, HookPostStop)
+}
+
+// shutdown shuts a running VM down cleanly: with shutdown -P over SSH, with the ACPI power button when SSH fails,
+// guests without acpid ignoring it. It is powered off if still running after XBEE_VBOX_STOP_TIMEOUT (1m by default).
+// VMs in other states are brought to poweroff by ensureOff.
+func (vm *Vm) shutdown(ctx context.Context) *cmd.XbeeError {
+	if vm.info.MachineState() != MachineRunning {
+		return vm.ensureOff(ctx)
+	}
+	if DryRun() {
+		log2.Infof("[dry-run] %s : would shut down the guest, then power off after %v", vm.HostName, envDuration(envStopTimeout, time.Minute))
+		return nil
+	}
+	log2.Infof("%s : shut down...", vm.HostName)
+	if conn, err := vm.guestConn(); err != nil || conn == nil || conn.RunCommandQuiet("sudo shutdown -P now") != nil {
+		if err != nil {
+			log2.Debugf("%s : no SSH connection, press the ACPI power button : %v", vm.HostName, err)
+		}
+		if err := vm.Vbox().AcpiPowerButton(ctx); err != nil {
+			return err
+		}
+	}
+	vm.conn = nil
+	timeout := envDuration(envStopTimeout, time.Minute)
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := vm.waitDown(waitCtx); err == nil {
+		log2.Infof("%s : vm is down", vm.HostName)
+		return nil
+	} else if ctx.Err() != nil {
+		return err
+	}
+	log2.Warnf("%s : vm still running after %v, power off", vm.HostName, timeout)
+	if err := vm.Vbox().PowerOff(ctx); err != nil {
+		return err
+	}
+	return vm.waitDown(ctx)
+}
+
+// suspend saves a running or paused VM to disk. Its NAT rules and shared folders are kept for resume.
+func (vm *Vm) suspend(ctx context.Context) *cmd.XbeeError {
+	log2.Infof("%s : save state of %s vm...", vm.HostName, vm.info.MachineState())
+	if err := vm.Vbox().SaveState(ctx); err != nil {
+		return err
+	}
+	vm.conn = nil
+	return vm.refresh(ctx)
+}
+
+// resume restarts a suspended VM as it was: no reconfiguration, the ssh port is the one already forwarded.
+// Pre-start hooks run first, Vms.Resume runs post-start ones once the guest is ready.
+func (vm *Vm) resume(ctx context.Context) *cmd.XbeeError {
+	if err := vm.runHooks(ctx, HookPreStart); err != nil {
+		return err
+	}
+	state := vm.info.MachineState()
+	log2.Infof("%s : resume %s vm...", vm.HostName, state)
+	var err *cmd.XbeeError
+	if state == MachinePaused {
+		err = vm.Vbox().Resume(ctx)
+	} else {
+		err = vm.Vbox().Start(ctx, vm.StartType())
+	}
+	if err != nil {
+		return err
+	}
+	if err := vm.refresh(ctx); err != nil {
+		return err
+	}
+	vm.sshPort = vm.info.HostPorts()
+	return nil
+}
@@ -0,0 +1,86 @@
+// Command parsers checks the VBoxManage output parsers against the corpus in specs/outputs.
+// Each <name>.txt is an output of VBoxManage; <name>.json gives its format (machinereadable or list)
+// and, for each record, values expected for some keys.
+//
+//	go run ./test/parsers [corpus folder]
+//
+// go test ./... checks specs/outputs too.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iodasolutions/virtualbox"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type expectation struct {
+	Format  string              `json:"format"`
+	Records []map[string]string `json:"records"`
+}
+
+func main() {
+	folder := "specs/outputs"
+	if len(os.Args) > 1 {
+		folder = os.Args[1]
+	}
+	files, err := filepath.Glob(filepath.Join(folder, "*.json"))
+	if err != nil || len(files) == 0 {
+		log.Fatalf("no corpus found in %s", folder)
+	}
+	failures := 0
+	for _, file := range files {
+		for _, problem := range check(file) {
+			fmt.Printf("%s : %s\n", filepath.Base(file), problem)
+			failures++
+		}
+	}
+	if failures > 0 {
+		log.Fatalf("%d failure(s)", failures)
+	}
+	fmt.Printf("%d outputs parsed as expected\n", len(files))
+}
+
+func check(file string) (problems []string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var expected expectation
+	if err := json.Unmarshal(data, &expected); err != nil {
+		return []string{err.Error()}
+	}
+	content, err := os.ReadFile(strings.TrimSuffix(file, ".json") + ".txt")
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var records [][]virtualbox.Pair
+	switch expected.Format {
+	case "machinereadable":
+		records = [][]virtualbox.Pair{virtualbox.ParseMachineReadable(string(content))}
+	case "list":
+		records = virtualbox.ParseColonList(string(content))
+	default:
+		return []string{fmt.Sprintf("unknown format %s", expected.Format)}
+	}
+	if len(records) != len(expected.Records) {
+		problems = append(problems, fmt.Sprintf("%d records parsed, %d expected", len(records), len(expected.Records)))
+	}
+	for i := 0; i < len(records) && i < len(expected.Records); i++ {
+		values := map[string]string{}
+		for _, kv := range records[i] {
+			values[kv.Key] = kv.Value
+		}
+		for key, want := range expected.Records[i] {
+			if got, ok := values[key]; !ok {
+				problems = append(problems, fmt.Sprintf("record %d : key %q not found", i, key))
+			} else if got != want {
+				problems = append(problems, fmt.Sprintf("record %d : %q is %q, expected %q", i, key, got, want))
+			}
+		}
+	}
+	return
+}
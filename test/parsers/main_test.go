@@ -0,0 +1,19 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestCorpus checks the corpus of specs/outputs like main does, so that go test ./... runs it.
+func TestCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "specs", "outputs", "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no corpus found in specs/outputs")
+	}
+	for _, file := range files {
+		for _, problem := range check(file) {
+			t.Errorf("%s : %s", filepath.Base(file), problem)
+		}
+	}
+}
@@ -3,50 +3,171 @@ package virtualbox
 import (
 	"context"
 	"fmt"
-	"github.com/iodasolutions/virtualbox/properties"
 	"github.com/iodasolutions/xbee-common/cmd"
 	"github.com/iodasolutions/xbee-common/log2"
 	"github.com/iodasolutions/xbee-common/newfs"
-	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var vboxLock = &sync.Mutex{}
 
 type Vbox struct {
-	name string
+	name   string
+	runner Runner
+	retry  RetryPolicy
+}
+
+func (vbox *Vbox) caps() (*Capabilities, *cmd.XbeeError) {
+	return CurrentCapabilities()
 }
 
 func VboxFrom(name string) *Vbox {
 	return &Vbox{
-		name: name,
+		name:   name,
+		runner: decorate(currentRunner()),
+		retry:  currentRetryPolicy(),
+	}
+}
+
+// run executes VBoxManage and returns the parsed diagnostic when it fails.
+// Transient failures of commands which are safe to retry are retried according to the retry policy, as long as ctx
+// is not done.
+func (vbox *Vbox) run(ctx context.Context, partialCommand ...string) (string, *VboxError) {
+	delay := vbox.retry.InitialDelay
+	for attempt := 1; ; attempt++ {
+		out, err := vbox.runner.Run(ctx, partialCommand...)
+		if err == nil {
+			if attempt > 1 {
+				log2.Infof("VBoxManage %s succeeded after %d attempts", partialCommand[0], attempt)
+			}
+			return out, nil
+		}
+		vErr := newVboxError(partialCommand, out, err)
+		if !vErr.Retryable() || !retrySafe(partialCommand) || attempt >= vbox.retry.MaxAttempts || ctx.Err() != nil {
+			return "", vErr
+		}
+		log2.Warnf("VBoxManage %s failed (attempt %d/%d) : %s. Retry in %v", strings.Join(partialCommand, " "), attempt, vbox.retry.MaxAttempts, vErr.Message(), delay)
+		select {
+		case <-ctx.Done():
+			return "", vErr
+		case <-time.After(delay):
+		}
+		delay = vbox.retry.nextDelay(delay)
 	}
 }
 
 func (vbox *Vbox) execute(ctx context.Context, partialCommand ...string) (string, *cmd.XbeeError) {
-	aCmd := exec.CommandContext(ctx, properties.VboxPath(), partialCommand...)
-	out, err := aCmd.CombinedOutput()
+	out, err := vbox.run(ctx, partialCommand...)
+	return out, err.XbeeError()
+}
+
+// Start starts the VM with startType: headless, gui or separate.
+func (vbox *Vbox) Start(ctx context.Context, startType string) *cmd.XbeeError {
+	caps, err := vbox.caps()
 	if err != nil {
-		commandS := properties.VboxPath() + " " + strings.Join(partialCommand, " ")
-		return "", cmd.Error("command %s failed : output is :\n%s", commandS, out)
+		return err
+	}
+	_, err = vbox.execute(ctx, append([]string{"startvm", vbox.name}, caps.StartArgs(startType)...)...)
+	return err
+}
+
+// Unregister succeeds when the VM is already unregistered.
+func (vbox *Vbox) Unregister(ctx context.Context) *cmd.XbeeError {
+	_, err := vbox.run(ctx, "unregistervm", vbox.name)
+	if err.NotFound() {
+		log2.Debugf("vm %s is already unregistered", vbox.name)
+		return nil
 	}
-	return string(out), nil
+	return err.XbeeError()
 }
 
-func (vbox *Vbox) Start(ctx context.Context) *cmd.XbeeError {
-	_, err := vbox.execute(ctx, "startvm", vbox.name, "-type", "headless")
+// PowerOff succeeds when the VM is not running.
+func (vbox *Vbox) PowerOff(ctx context.Context) *cmd.XbeeError {
+	_, err := vbox.run(ctx, "controlvm", vbox.name, "poweroff")
+	if err != nil && err.Kind == KindInvalidState {
+		log2.Debugf("vm %s is not running : %s", vbox.name, err.Message())
+		return nil
+	}
+	return err.XbeeError()
+}
+
+// AcpiPowerButton asks the guest to shut down, as the power button of a real machine.
+func (vbox *Vbox) AcpiPowerButton(ctx context.Context) *cmd.XbeeError {
+	_, err := vbox.execute(ctx, "controlvm", vbox.name, "acpipowerbutton")
 	return err
 }
 
-func (vbox *Vbox) Unregister(ctx context.Context) *cmd.XbeeError {
-	_, err := vbox.execute(ctx, "unregistervm", vbox.name)
+func (vbox *Vbox) Pause(ctx context.Context) *cmd.XbeeError {
+	_, err := vbox.execute(ctx, "controlvm", vbox.name, "pause")
+	return err
+}
+
+// Resume continues a paused VM.
+func (vbox *Vbox) Resume(ctx context.Context) *cmd.XbeeError {
+	_, err := vbox.execute(ctx, "controlvm", vbox.name, "resume")
+	return err
+}
+
+// DiscardState drops the saved state of a VM, which is then powered off.
+func (vbox *Vbox) DiscardState(ctx context.Context) *cmd.XbeeError {
+	_, err := vbox.execute(ctx, "discardstate", vbox.name)
+	return err
+}
+
+// SaveState writes the memory of a running or paused VM to disk and stops it.
+func (vbox *Vbox) SaveState(ctx context.Context) *cmd.XbeeError {
+	_, err := vbox.execute(ctx, "controlvm", vbox.name, "savestate")
+	return err
+}
+
+// Screenshot saves the display of a running VM to a PNG file.
+func (vbox *Vbox) Screenshot(ctx context.Context, png newfs.File) *cmd.XbeeError {
+	caps, err := vbox.caps()
+	if err != nil {
+		return err
+	}
+	if err := caps.Require(FeatureScreenshot); err != nil {
+		return err
+	}
+	_, err = vbox.execute(ctx, "controlvm", vbox.name, "screenshotpng", png.String())
+	return err
+}
+
+func (vbox *Vbox) StopRecording(ctx context.Context) *cmd.XbeeError {
+	caps, err := vbox.caps()
+	if err != nil {
+		return err
+	}
+	_, err = vbox.execute(ctx, "controlvm", vbox.name, caps.RecordingControl(), "off")
 	return err
 }
 
-func (vbox *Vbox) showVmInfo(ctx context.Context) (string, *cmd.XbeeError) {
-	return vbox.execute(ctx, "showvminfo", vbox.name, "--machinereadable")
+func (vbox *Vbox) SetExtraData(ctx context.Context, key string, value string) *cmd.XbeeError {
+	_, err := vbox.execute(ctx, "setextradata", vbox.name, key, value)
+	return err
+}
+
+// ExtraData returns every extradata of the VM.
+func (vbox *Vbox) ExtraData(ctx context.Context) (map[string]string, *cmd.XbeeError) {
+	//Key: xbee/EnvId, Value: dev
+	out, err := vbox.execute(ctx, "getextradata", vbox.name, "enumerate")
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]string{}
+	for _, line := range splitLines(out) {
+		if key, value, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "Key: "), ", Value: "); ok {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+func (vbox *Vbox) showVmInfo(ctx context.Context) (string, *VboxError) {
+	return vbox.run(ctx, "showvminfo", vbox.name, "--machinereadable")
 }
 
 func (vbox *Vbox) Modify(ctx context.Context, args ...string) *cmd.XbeeError {
@@ -65,11 +186,30 @@ func (vbox *Vbox) AddSharedFolder(ctx context.Context, hostPath string, mountNam
 }
 
 func (vbox *Vbox) AddNATRule(ctx context.Context, key string, hostPort string, guestPort string) *cmd.XbeeError {
-	return vbox.Modify(ctx, "--natpf1", fmt.Sprintf("%s,tcp,,%s,,%s", key, hostPort, guestPort))
+	return vbox.Batch().AddNATRule(key, hostPort, guestPort).Flush(ctx)
 }
 
 func (vbox *Vbox) DeleteNATRule(ctx context.Context, key string) *cmd.XbeeError {
-	return vbox.Modify(ctx, "--natpf1", "delete", key)
+	return vbox.Batch().DeleteNATRule(key).Flush(ctx)
+}
+
+// AddLiveNATRule adds a port forwarding rule to a running VM, modifyvm requires it to be off.
+func (vbox *Vbox) AddLiveNATRule(ctx context.Context, key string, hostPort string, guestPort string) *cmd.XbeeError {
+	caps, err := vbox.caps()
+	if err != nil {
+		return err
+	}
+	_, err = vbox.execute(ctx, "controlvm", vbox.name, caps.NATRuleControl(1), fmt.Sprintf("%s,tcp,,%s,,%s", key, hostPort, guestPort))
+	return err
+}
+
+func (vbox *Vbox) DeleteLiveNATRule(ctx context.Context, key string) *cmd.XbeeError {
+	caps, err := vbox.caps()
+	if err != nil {
+		return err
+	}
+	_, err = vbox.execute(ctx, "controlvm", vbox.name, caps.NATRuleControl(1), "delete", key)
+	return err
 }
 
 func (vbox *Vbox) CreateMedium(ctx context.Context, location newfs.File, size int, format string) *cmd.XbeeError {
@@ -79,8 +219,20 @@ func (vbox *Vbox) CreateMedium(ctx context.Context, location newfs.File, size in
 		"--format", format)
 	return err
 }
+
+// RemoveMedium succeeds when the medium is already deleted.
 func (vbox *Vbox) RemoveMedium(ctx context.Context, location newfs.File) *cmd.XbeeError {
-	_, err := vbox.execute(ctx, "closemedium", "disk", location.String(), "--delete")
+	_, err := vbox.run(ctx, "closemedium", "disk", location.String(), "--delete")
+	if err.NotFound() {
+		log2.Debugf("medium %s is already deleted", location)
+		return nil
+	}
+	return err.XbeeError()
+}
+
+// SetMediumType changes the type of a medium attached to no VM (normal, writethrough...).
+func (vbox *Vbox) SetMediumType(ctx context.Context, location newfs.File, mtype string) *cmd.XbeeError {
+	_, err := vbox.execute(ctx, "modifymedium", "disk", location.String(), "--type", mtype)
 	return err
 }
 
@@ -122,13 +274,13 @@ func (vbox *Vbox) removeDhcpServer(ctx context.Context, xbeenetName string) *cmd
 	return err
 }
 
-func (vbox *Vbox) remoteIntNet(ctx context.Context) *cmd.XbeeError {
+func (vbox *Vbox) remoteIntNet(ctx context.Context, netName string) *cmd.XbeeError {
 	if _, err := vbox.execute(ctx, "natnetwork", "modify",
-		"--netname", DefaultNet(), "--disable"); err != nil {
+		"--netname", netName, "--disable"); err != nil {
 		return err
 	}
 	if _, err := vbox.execute(ctx, "natnetwork", "remove",
-		"--netname", DefaultNet()); err != nil {
+		"--netname", netName); err != nil {
 		return err
 	}
 	return nil
@@ -175,15 +327,26 @@ func (vbox *Vbox) cloneMedium(ctx context.Context, source newfs.File, target new
 
 func (vbox *Vbox) export(ctx context.Context) (*newfs.File, *cmd.XbeeError) {
 	//VBoxManage export "ubuntu-24.04-458d73ae7c_xbee-system-packs-b6ddd5d83b" --output /tmp/vm_export.ova
+	hv := currentHypervisor()
 	ovafile := newfs.TmpDir().ChildFile(vbox.name + ".ova")
-	defer ovafile.EnsureDelete()
+	defer hv.RemoveAll(ovafile.String())
 	if _, err := vbox.execute(ctx, "export", vbox.name, "--output", ovafile.String()); err != nil {
 		return nil, err
 	}
+	if DryRun() {
+		return nil, nil
+	}
 	targetDir := newfs.TmpDir().ChildFolder(vbox.name)
-	if err := ovafile.Untar(targetDir.String()); err != nil {
+	if err := hv.Untar(ovafile.String(), targetDir.String()); err != nil {
 		return nil, err
 	}
-	vmdk := targetDir.ChildrenFilesEndingWith(".vmdk")[0]
+	children, err := hv.FilesEndingWith(targetDir.String(), ".vmdk")
+	if err != nil {
+		return nil, err
+	}
+	if len(children) == 0 {
+		return nil, cmd.Error("export of vm %s gave no vmdk disk in %s", vbox.name, ovafile)
+	}
+	vmdk := newfs.NewFile(children[0])
 	return &vmdk, nil
 }
@@ -10,10 +10,10 @@ import (
 	"github.com/iodasolutions/xbee-common/newfs"
 	"github.com/iodasolutions/xbee-common/provider"
 	"github.com/iodasolutions/xbee-common/ssh2"
-	"github.com/iodasolutions/xbee-common/util"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,7 +35,7 @@ type Vm struct {
 	conn                 *ssh2.SSHClient // set by waitSSH
 }
 
-func fromHost(ctx context.Context, h *provider.XbeeHost) (*Vm, error) {
+func fromHost(h *provider.XbeeHost) (*Vm, error) {
 	theH, err := NewHost(h)
 	if err != nil {
 		return nil, err
@@ -46,10 +46,19 @@ func fromHost(ctx context.Context, h *provider.XbeeHost) (*Vm, error) {
 		Host:     theH,
 		Ports:    h.Ports,
 	}
-	vm.info = VmInfoFor(ctx, vm.Name())
 	return vm, nil
 }
 
+// refresh reads the configuration of the VM again.
+func (vm *Vm) refresh(ctx context.Context) *cmd.XbeeError {
+	info, err := VmInfoFor(ctx, vm.Name())
+	if err != nil {
+		return err
+	}
+	vm.info = info
+	return nil
+}
+
 func (vm *Vm) Name() string {
 	return fmt.Sprintf("%s_%s", vm.HostName, provider.EnvId())
 }
@@ -70,12 +79,11 @@ func (vm *Vm) Vbox() *Vbox {
 }
 
 func (vm *Vm) Destroy(ctx context.Context) *cmd.XbeeError {
-	state := vm.info.State()
-	if state == constants.State.Up {
-		vb := vm.Vbox()
-		if _, err := vb.execute(ctx, "controlvm", vb.name, "poweroff"); err != nil {
-			return err
-		}
+	if err := vm.runHooks(ctx, HookPreDestroy); err != nil {
+		return err
+	}
+	if err := vm.ensureOff(ctx); err != nil {
+		return err
 	}
 	if err := vm.AfterDown(ctx); err != nil {
 		return err
@@ -83,17 +91,23 @@ func (vm *Vm) Destroy(ctx context.Context) *cmd.XbeeError {
 	if err := vm.EnsureVolumesDetached(ctx); err != nil {
 		return err
 	}
+	// only the differencing disk of a linked clone is deleted, the disk of its base VM is kept
+	systemDisk := vm.systemDisk()
 	if err := vm.Vbox().Unregister(ctx); err != nil {
 		return err
 	}
-	if err := vm.Vbox().RemoveMedium(ctx, vm.VirtualDisk()); err != nil {
+	if err := vm.Vbox().RemoveMedium(ctx, systemDisk); err != nil {
 		return err
 	}
-	if err := vm.Folder().Delete(); err != nil {
-		return err
+	if DryRun() {
+		log2.Infof("[dry-run] %s : would delete folder %s", vm.HostName, vm.Folder())
+	} else {
+		if err := currentHypervisor().RemoveAll(vm.Folder().String()); err != nil {
+			return err
+		}
+		log2.Infof("%s : vm removed", vm.HostName)
 	}
-	log2.Infof("%s : vm removed", vm.HostName)
-	return nil
+	return vm.runHooks(ctx, HookPostDestroy)
 }
 
 func extractVmdk(aPath newfs.File) (newfs.File, *cmd.XbeeError) {
@@ -142,117 +156,244 @@ func extractVmdk(aPath newfs.File) (newfs.File, *cmd.XbeeError) {
 func (vm *Vm) VirtualDisk() newfs.File {
 	return vm.Folder().ChildFile("xbee-system.vmdk")
 }
+
+// systemDisk is the disk attached on SATA port 0: VirtualDisk, or the differencing disk of a linked clone.
+func (vm *Vm) systemDisk() newfs.File {
+	if a := vm.info.Machine().Controller("SATA").Attachment(0, 0); a != nil {
+		return newfs.NewFile(a.Medium)
+	}
+	return vm.VirtualDisk()
+}
+
+// originDiskLock prevents hosts created in parallel from downloading or extracting the same disk together.
+var originDiskLock = &sync.Mutex{}
+
 func (vm *Vm) computeOriginVmdk(ctx context.Context) (err *cmd.XbeeError) {
-	originDisk := vm.Host.OriginDisk()
-	if !originDisk.Exists() {
-		if originDisk, err = DownloadIfNotCached(ctx, vm.Host.Specification.Disk); err != nil {
+	originDiskLock.Lock()
+	defer originDiskLock.Unlock()
+	hv := currentHypervisor()
+	origin, err := vm.Host.OriginDisk()
+	if err != nil {
+		return
+	}
+	originDisk := origin.String()
+	if !hv.Exists(originDisk) {
+		if originDisk, err = hv.Download(ctx, vm.Host.Specification.Disk); err != nil {
 			return
 		}
-		if originDisk, err = extractVmdk(originDisk); err != nil {
+		if DryRun() {
+			log2.Infof("[dry-run] %s : would extract vmdk from %s", vm.HostName, originDisk)
+		} else if originDisk, err = hv.ExtractVmdk(originDisk); err != nil {
 			return
 		}
 		if vm.guestAddition, err = EnsureGuestAdditions(ctx); err != nil {
 			return
 		}
 	}
-	vm.originDisk = originDisk
+	vm.originDisk = newfs.NewFile(originDisk)
 	return
 }
 
-func (vm *Vm) prepareForCreation(ctx context.Context) (err *cmd.XbeeError) {
+// prepareForCreation records in tx how to undo each step.
+func (vm *Vm) prepareForCreation(ctx context.Context, tx *rollback) (err *cmd.XbeeError) {
 	if err = vm.computeOriginVmdk(ctx); err != nil {
 		return
 	}
-	//	vmdkOrigin.CopyToPath(vm.VirtualDisk())
 	vb := vm.Vbox()
-	log2.Infof("Create disk %s", vm.VirtualDisk())
-	if err = vb.cloneMedium(ctx, vm.originDisk, vm.VirtualDisk()); err != nil {
-		return err
+	tx.undoFolder()
+	if LinkedClones() {
+		err = vm.createLinkedClone(ctx, tx)
+	} else {
+		err = vm.createFullClone(ctx, tx)
 	}
-	log2.Infof("%s : Host does not exist, first create it", vm.HostName)
-	if _, err = vb.execute(ctx, "createvm", "--name", vm.Name(), "--ostype", vm.Host.Specification.OsType, "--register"); err != nil {
+	if err != nil {
 		return
 	}
-	if _, err = vb.execute(ctx, "storagectl", vm.Name(), "--name", "SATA", "--add", "sata"); err != nil {
-		return err
+	if err = vm.tag(ctx); err != nil {
+		return
 	}
-	if _, err = vb.execute(ctx, "storagectl", vm.Name(), "--name", "IDE", "--add", "IDE"); err != nil {
-		return err
+	batch := vb.Batch().Set("boot order", "--boot1", "disk")
+	vm.configureNic(batch)
+	vm.configureConsole(batch)
+	if err = vm.configureRecording(batch); err != nil {
+		return
 	}
-	if err = vb.Modify(ctx, "--boot1", "disk"); err != nil {
+	if err = batch.Flush(ctx); err != nil {
 		return
 	}
 	iso := IsoFor(vm)
 	if err = iso.CreateAndAttach(ctx); err != nil {
 		return
 	}
+	tx.add("seed iso "+iso.File().String(), iso.DetachAndDelete)
 	if vm.guestAddition != nil {
 		if err = vb.attacheDvdStorage(ctx, *vm.guestAddition, "1"); err != nil {
 			return
 		}
 	}
-	if err = vb.attachHddStorage(ctx, vm.VirtualDisk(), "0"); err != nil {
-		return
+	return
+}
+
+// createFullClone creates the VM with its own copy of the origin disk.
+func (vm *Vm) createFullClone(ctx context.Context, tx *rollback) *cmd.XbeeError {
+	//	vmdkOrigin.CopyToPath(vm.VirtualDisk())
+	vb := vm.Vbox()
+	log2.Infof("Create disk %s", vm.VirtualDisk())
+	if err := vb.cloneMedium(ctx, vm.originDisk, vm.VirtualDisk()); err != nil {
+		return err
 	}
-	if err = vm.configureNic(ctx); err != nil {
-		return
+	tx.undoSystemDisk(vm.VirtualDisk().String())
+	log2.Infof("%s : Host does not exist, first create it", vm.HostName)
+	if _, err := vb.execute(ctx, "createvm", "--name", vm.Name(), "--ostype", vm.Host.Specification.OsType, "--register"); err != nil {
+		return err
 	}
-	return
+	tx.undoRegistration()
+	if _, err := vb.execute(ctx, "storagectl", vm.Name(), "--name", "SATA", "--add", "sata"); err != nil {
+		return err
+	}
+	if _, err := vb.execute(ctx, "storagectl", vm.Name(), "--name", "IDE", "--add", "IDE"); err != nil {
+		return err
+	}
+	return vb.attachHddStorage(ctx, vm.VirtualDisk(), "0")
 }
 
-func (vm *Vm) waitUntilCloudInitFinished() *cmd.XbeeError {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Minute)
-	ff := func(ctx context.Context) *cmd.XbeeError {
-		for {
-			out, _ := vm.conn.RunCommandToOut("if [ -f /var/lib/cloud/instance/boot-finished ]; then echo 1; else echo 0; fi")
-			out = strings.TrimSpace(out)
-			if out == "1" {
-				return nil
+// up creates the VM if needed, starts it and prepares its guest for xbee. Creation and start hold a slot.
+func (vm *Vm) up(ctx context.Context, slots chan struct{}) (err *cmd.XbeeError) {
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return cmd.Error("%v", ctx.Err())
+	}
+	err = vm.createAndStart(ctx)
+	<-slots
+	if err != nil {
+		return
+	}
+	if DryRun() {
+		return vm.runHooks(ctx, HookPostStart)
+	}
+	if err = vm.waitSSH(ctx); err != nil {
+		return vm.withScreenshot(err)
+	}
+	if vm.InitiallyNotExisting {
+		if err = vm.waitUntilCloudInitFinished(ctx); err != nil {
+			return vm.withScreenshot(err)
+		}
+		if err = vm.stopRecording(ctx); err != nil {
+			return
+		}
+		if vm.guestAddition != nil {
+			var script string
+			if script, err = GuestAdditionScript(); err != nil {
+				return
+			}
+			if err = vm.conn.RunScript(script); err != nil {
+				return
 			}
-			time.Sleep(time.Second)
+			log2.Infof("%s : guest addition installed", vm.HostName)
 		}
 	}
-	return util.Execute(ctx, ff)
+	if err = vm.conn.RunCommand("sudo mkdir -p /root/.xbee/cache-artefacts && sudo mount -t vboxsf xbee /root/.xbee/cache-artefacts"); err != nil {
+		return
+	}
+	log2.Infof("%s : shared folder xbee mounted", vm.HostName)
+	if vm.InitiallyNotExisting {
+		if err = vm.conn.RunCommand("sudo cp /root/.xbee/cache-artefacts/s3.eu-west-3.amazonaws.com/xbee.repository.public/linux_amd64/xbee /usr/bin"); err != nil {
+			return
+		}
+	}
+	if err = vm.waitProbes(ctx); err != nil {
+		return
+	}
+	return vm.runHooks(ctx, HookPostStart)
+}
+
+// createAndStart undoes the creation of a new VM when it cannot be started.
+func (vm *Vm) createAndStart(ctx context.Context) *cmd.XbeeError {
+	if !vm.NotExisting() {
+		vm.InitiallyDown = true
+		return vm.Start(ctx)
+	}
+	vm.InitiallyNotExisting = true
+	if err := vm.runHooks(ctx, HookPreCreate); err != nil {
+		return err
+	}
+	tx := &rollback{vm: vm}
+	if err := vm.prepareForCreation(ctx, tx); err != nil {
+		return tx.run(err)
+	}
+	if err := vm.runHooks(ctx, HookPostCreate); err != nil {
+		return tx.run(err)
+	}
+	if err := vm.Start(ctx); err != nil {
+		return tx.run(err)
+	}
+	return nil
 }
 
+// waitDown polls the state of the VM every second until it is down, or ctx is done.
 func (vm *Vm) waitDown(ctx context.Context) *cmd.XbeeError {
-	ff := func(ctx context.Context) *cmd.XbeeError {
-		for {
-			vm.info = VmInfoFor(ctx, vm.Name())
-			if vm.info.State() == constants.State.Down {
-				return nil
+	if DryRun() {
+		return nil
+	}
+	for ctx.Err() == nil {
+		if err := vm.refresh(ctx); err != nil {
+			if ctx.Err() != nil {
+				break
 			}
-			time.Sleep(time.Second)
+			return err
+		}
+		if vm.info.State() == constants.State.Down {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
 		}
 	}
-	return util.Execute(ctx, ff)
+	return cmd.Error("%s : vm is not down : %v", vm.HostName, ctx.Err())
 }
 
 func (vm *Vm) waitSSH(ctx context.Context) *cmd.XbeeError {
 	log2.Infof("%s : wait until SSH open...", vm.HostName)
-	ff := func(_ context.Context) *cmd.XbeeError {
-		for {
-			var err *cmd.XbeeError
-			vm.conn, err = ssh2.Connect("127.0.0.1", vm.sshPort, vm.User)
-			if err == nil {
-				return nil
-			}
-			log2.Infof("%s : SSH connection to 127.0.0.1:%s still not opened for user %s", vm.HostName, vm.sshPort, vm.User)
-			time.Sleep(time.Second)
+	address := currentHypervisor().Address()
+	timeout := envDuration(envSSHTimeout, 10*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for ctx.Err() == nil {
+		conn, err := ssh2.Connect(address, vm.sshPort, vm.User)
+		if err == nil {
+			vm.conn = conn
+			log2.Infof("%s : SSH connexion OK", vm.HostName)
+			return nil
+		}
+		log2.Infof("%s : SSH connection to %s:%s still not opened for user %s", vm.HostName, address, vm.sshPort, vm.User)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
 		}
 	}
-	if err := util.Execute(ctx, ff); err != nil {
-		return err
-	}
-	log2.Infof("%s : SSH connexion OK", vm.HostName)
-	return nil
+	return vm.withConsole(cmd.Error("%s : SSH connection to %s:%s not opened after %v : %v", vm.HostName, address, vm.sshPort, timeout, ctx.Err()))
 }
 
 func (vm *Vm) ExportToVmdk(ctx context.Context) (err *cmd.XbeeError) {
-	vm.conn, err = ssh2.Connect("127.0.0.1", vm.SSHPort(), vm.User)
+	if DryRun() {
+		if err = vm.runHooks(ctx, HookPreImage); err != nil {
+			return
+		}
+		log2.Infof("[dry-run] %s : would run 'sudo cloud-init clean' and 'sudo shutdown -P now' on guest", vm.HostName)
+		if _, err = vm.Vbox().export(ctx); err != nil {
+			return
+		}
+		return vm.runHooks(ctx, HookPostImage)
+	}
+	vm.conn, err = ssh2.Connect(currentHypervisor().Address(), vm.SSHPort(), vm.User)
 	if err != nil {
 		return
 	}
+	if err = vm.runHooks(ctx, HookPreImage); err != nil {
+		return
+	}
 	if err = vm.conn.RunCommandQuiet("sudo cloud-init clean"); err != nil {
 		return
 	}
@@ -265,33 +406,50 @@ func (vm *Vm) ExportToVmdk(ctx context.Context) (err *cmd.XbeeError) {
 	if err = vm.AfterDown(ctx); err != nil {
 		return
 	}
+	targetDisk, err := vm.Host.TargetDiskForImage()
+	if err != nil {
+		return
+	}
 	var vmdkPath *newfs.File
 	if vmdkPath, err = vm.Vbox().export(ctx); err != nil {
 		return
 	}
-	defer vmdkPath.Dir().Delete()
+	hv := currentHypervisor()
+	defer hv.RemoveAll(vmdkPath.Dir().String())
 	log2.Infof("Export vm %s to [%s]...", vm.HostName, vmdkPath)
-	targetDisk := vm.Host.TargetDiskForImage()
-	targetDisk.Dir().EnsureExists()
-	if err2 := os.Rename(vmdkPath.String(), targetDisk.String()); err2 != nil {
+	if err2 := hv.Rename(vmdkPath.String(), targetDisk.String()); err2 != nil {
 		err = cmd.Error("failed to move %s to %s", vmdkPath, targetDisk.String())
+		return
 	}
-	return
+	// export flattens the disk of a linked clone, the image does not depend on a base VM
+	if err = retireBaseVm(ctx, vm.Host.targetHashForImage()); err != nil {
+		return
+	}
+	return vm.runHooks(ctx, HookPostImage)
 }
 
-func (vm *Vm) configureNic(ctx context.Context) *cmd.XbeeError {
-	vb := vm.Vbox()
-	if err := vb.Modify(ctx, "--nic1", "nat"); err != nil {
-		return err
+func (vm *Vm) configureNic(batch *ModifyBatch) {
+	batch.Set("NAT adapter", "--nic1", "nat")
+	batch.Set("internal network adapter", "--nic2", "intnet")
+	batch.Set("internal network name", batch.caps().IntNetArgs(2, DefaultNet())...)
+}
+
+// StartType is XBEE_VBOX_START_TYPE when set, to debug every host, the start-type of the host otherwise.
+func (vm *Vm) StartType() string {
+	if value := os.Getenv(envStartType); value != "" {
+		if validStartType(value) {
+			return value
+		}
+		log2.Warnf("ignore %s=%s : expected one of %s", envStartType, value, strings.Join(StartTypes, ", "))
 	}
-	if err := vb.Modify(ctx, "--nic2", "intnet"); err != nil {
-		return err
+	if vm.Host.Specification.StartType != "" {
+		return vm.Host.Specification.StartType
 	}
-	return vb.Modify(ctx, "--intnet2", DefaultNet())
+	return "headless"
 }
 
 func (vm *Vm) Start(ctx context.Context) (err *cmd.XbeeError) {
-	if err = vm.DeleteNATRules(ctx); err != nil {
+	if err = vm.runHooks(ctx, HookPreStart); err != nil {
 		return
 	}
 	if err = vm.EnsureXbeeSharedFolder(ctx); err != nil {
@@ -300,24 +458,34 @@ func (vm *Vm) Start(ctx context.Context) (err *cmd.XbeeError) {
 	if err = vm.EnsureHostVolumesExistAndAttached(ctx); err != nil {
 		return
 	}
-	if err = vm.configureSharedPorts(ctx); err != nil {
-		return
+	// NAT rules, ports, memory and cpus are applied with a single modifyvm
+	batch := vm.Vbox().Batch()
+	vm.deleteNATRules(batch)
+	vm.configureSharedPorts(batch)
+	vm.configureMemoryAndCpus(batch)
+	// the first boot of a created VM is recorded until stopRecording
+	if !vm.InitiallyNotExisting {
+		vm.disableRecording(batch)
 	}
-	if err = vm.configureMemoryAndCpus(ctx); err != nil {
+	if err = batch.Flush(ctx); err != nil {
 		return
 	}
 	log2.Infof("%s : Start vm...", vm.HostName)
-	if err = vm.Vbox().Start(ctx); err != nil {
+	if err = vm.Vbox().Start(ctx, vm.StartType()); err != nil {
 		return
 	}
-	vm.info = VmInfoFor(ctx, vm.Name())
+	err = vm.refresh(ctx)
 	return
 }
 
+// EnsureXbeeSharedFolder shares the xbee cache artefacts with the guest. They are uploaded first to a remote hypervisor.
 func (vm *Vm) EnsureXbeeSharedFolder(ctx context.Context) *cmd.XbeeError {
+	folder, err := currentHypervisor().Upload(ctx, newfs.CacheArtefacts().String())
+	if err != nil {
+		return err
+	}
 	if _, ok := vm.info.SharedFolders()["xbee"]; !ok {
-
-		if err := vm.Vbox().AddSharedFolder(ctx, newfs.CacheArtefacts().String(), "xbee"); err != nil {
+		if err := vm.Vbox().AddSharedFolder(ctx, folder, "xbee"); err != nil {
 			return err
 		}
 	}
@@ -331,7 +499,7 @@ func (vm *Vm) EnsureHostVolumesExistAndAttached(ctx context.Context) *cmd.XbeeEr
 				return err
 			}
 		} else {
-			if !volume.File().Exists() {
+			if !currentHypervisor().Exists(volume.File().String()) {
 				if err2 := volume.create(ctx); err2 != nil {
 					return err2
 				}
@@ -347,7 +515,9 @@ func (vm *Vm) EnsureHostVolumesExistAndAttached(ctx context.Context) *cmd.XbeeEr
 func (vm *Vm) addSharedFolder(ctx context.Context, volumeName string) *cmd.XbeeError {
 	if volumeName != "" && strings.HasPrefix(volumeName, "/") {
 		hostFolder := newfs.NewFolder(volumeName)
-		hostFolder.EnsureExists()
+		if err := currentHypervisor().MkdirAll(hostFolder.String()); err != nil {
+			return err
+		}
 		log2.Infof("Configure in virtualbox shared folder \n\t(guest) %s\n\t(host) %s", hostFolder.Path.Hash(), volumeName)
 		return vm.Vbox().AddSharedFolder(ctx, hostFolder.String(), hostFolder.Path.Hash())
 	}
@@ -355,19 +525,18 @@ func (vm *Vm) addSharedFolder(ctx context.Context, volumeName string) *cmd.XbeeE
 }
 
 // configureMemoryAndCpus is used before starting a new or existing VM.
-func (vm *Vm) configureMemoryAndCpus(ctx context.Context) *cmd.XbeeError {
-	return vm.Vbox().Modify(ctx, "--memory", strconv.Itoa(vm.Host.Specification.Memory), "--cpus", strconv.Itoa(vm.Host.Specification.Cpus))
+func (vm *Vm) configureMemoryAndCpus(batch *ModifyBatch) {
+	batch.Set("memory", "--memory", strconv.Itoa(vm.Host.Specification.Memory))
+	batch.Set("cpus", "--cpus", strconv.Itoa(vm.Host.Specification.Cpus))
 }
 
 // configureSharedPorts is used before starting a new or existing VM.
-func (vm *Vm) configureSharedPorts(ctx context.Context) (err *cmd.XbeeError) {
-	if err = vm.assignSSHPortFromHost(ctx); err != nil {
-		return
-	}
-	return vm.ExposePorts(ctx, vm.Ports)
+func (vm *Vm) configureSharedPorts(batch *ModifyBatch) {
+	vm.assignSSHPortFromHost(batch)
+	vm.exposePorts(batch, vm.Ports)
 }
 
-func (vm *Vm) assignSSHPortFromHost(ctx context.Context) *cmd.XbeeError {
+func (vm *Vm) assignSSHPortFromHost(batch *ModifyBatch) {
 	sshPortS := vm.sshPort
 	if sshPortS == "" {
 		sshPortS = "0"
@@ -379,11 +548,8 @@ func (vm *Vm) assignSSHPortFromHost(ctx context.Context) *cmd.XbeeError {
 	NextPort.Lock()
 	defer NextPort.Unlock()
 	portS := NextPort.NextFreePort(strconv.Itoa(sshPort))
-	if err := vm.Vbox().Modify(ctx, "--natpf1", fmt.Sprintf("ssh,tcp,127.0.0.1,%s,,22", portS)); err != nil {
-		return err
-	}
+	batch.Set(fmt.Sprintf("ssh NAT rule (host port %s)", portS), batch.caps().NATRuleOption(1), fmt.Sprintf("ssh,tcp,%s,%s,,22", currentHypervisor().NATHostIP(), portS))
 	vm.sshPort = portS
-	return nil
 }
 
 func (vm *Vm) EnsureVolumesDetached(ctx context.Context) *cmd.XbeeError {
@@ -420,28 +586,37 @@ func (vm *Vm) AfterDown(ctx context.Context) *cmd.XbeeError {
 }
 
 func (vm *Vm) DeleteNATRules(ctx context.Context) *cmd.XbeeError {
-	for name, port := range vm.info.NATRules() {
-		if err := vm.Vbox().DeleteNATRule(ctx, name); err != nil {
-			return err
-		}
-		log2.Debugf("Deleted exposed port %s", port)
+	batch := vm.Vbox().Batch()
+	vm.deleteNATRules(batch)
+	return batch.Flush(ctx)
+}
+
+// deleteNATRules also forgets the rules in vm.info, so that they can be added again in the same batch.
+func (vm *Vm) deleteNATRules(batch *ModifyBatch) {
+	rules := vm.info.NATRules()
+	for name, port := range rules {
+		batch.DeleteNATRule(name)
+		delete(rules, name)
+		log2.Debugf("Delete exposed port %s", port)
 	}
-	return nil
 }
 
 func (vm *Vm) ExposePorts(ctx context.Context, ports []string) *cmd.XbeeError {
+	batch := vm.Vbox().Batch()
+	vm.exposePorts(batch, ports)
+	return batch.Flush(ctx)
+}
+
+func (vm *Vm) exposePorts(batch *ModifyBatch, ports []string) {
 	for _, port := range ports {
 		natKey := vm.info.natKeyFor(port)
 		if _, ok := vm.info.NATRules()[natKey]; ok {
 			log2.Warnf("port %s is already exposed for host %s. Skip action", strings.TrimLeft(natKey, "PRODUCT-"), vm.HostName)
 		} else {
 			hostPort, guestPort := vm.info.hostGuestPort(port)
-			if err := vm.Vbox().AddNATRule(ctx, natKey, hostPort, guestPort); err != nil {
-				return err
-			}
+			batch.AddNATRule(natKey, hostPort, guestPort)
 		}
 	}
-	return nil
 }
 
 func (vm *Vm) NotExistingOrDown() bool {
@@ -463,15 +638,24 @@ func (vm *Vm) InstanceInfo(ctx context.Context) (*provider.InstanceInfo, *cmd.Xb
 		}
 		ip = extraValueFrom(out)
 	}
+	packDisk, err := vm.Host.PackDisk()
+	if err != nil {
+		return nil, err
+	}
+	systemDisk, err := vm.Host.SystemDisk()
+	if err != nil {
+		return nil, err
+	}
+	hv := currentHypervisor()
 	return &provider.InstanceInfo{
 		Name:          vm.HostName,
 		State:         vm.info.State(),
-		ExternalIp:    "127.0.0.1",
+		ExternalIp:    hv.Address(),
 		SSHPort:       vm.SSHPort(),
 		Ip:            ip,
 		User:          vm.User,
-		PackIdExist:   vm.Host.PackDisk().Exists(),
-		SystemIdExist: vm.Host.SystemDisk().Exists(),
+		PackIdExist:   hv.Exists(packDisk.String()),
+		SystemIdExist: hv.Exists(systemDisk.String()),
 	}, nil
 }
 
@@ -493,3 +677,8 @@ func (vm *Vm) InternalIp(ctx context.Context) (string, error) {
 		}
 	}
 }
+
+// MachineInfo returns the VirtualBox configuration of the VM, as read last time. It is empty when the VM does not exist.
+func (vm *Vm) MachineInfo() *MachineInfo {
+	return vm.info.Machine()
+}
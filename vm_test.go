@@ -0,0 +1,173 @@
+package virtualbox
+
+import (
+	"context"
+	"github.com/iodasolutions/virtualbox/fakevbox"
+	"github.com/iodasolutions/xbee-common/cmd"
+	"github.com/iodasolutions/xbee-common/newfs"
+	"github.com/iodasolutions/xbee-common/provider"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useFakeVbox runs VBoxManage commands of the test with a fakevbox, whose machine folder is a temporary one.
+func useFakeVbox(t *testing.T) *fakevbox.VBoxManage {
+	t.Helper()
+	f := fakevbox.New(t.TempDir())
+	SetRunner(f)
+	t.Cleanup(func() { SetRunner(runnerFromEnv()) })
+	return f
+}
+
+// newTestVm creates a down VM for hostName as Up does, from a fake origin disk.
+func newTestVm(t *testing.T, ctx context.Context, hostName string, ports ...string) *Vm {
+	t.Helper()
+	origin := filepath.Join(t.TempDir(), "origin.vmdk")
+	if err := os.WriteFile(origin, []byte("system"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vm := &Vm{
+		HostName:   hostName,
+		Ports:      ports,
+		Host:       &Host{XbeeHost: &provider.XbeeHost{Name: hostName}, Specification: &VboxHostData{Memory: 1024, Cpus: 2}},
+		volumes:    map[string]*VboxVolume{},
+		originDisk: newfs.NewFile(origin),
+	}
+	if err := vm.createFullClone(ctx, &rollback{vm: vm}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.tag(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+// addTestVolume declares a volume of the host, created by Start in a temporary folder.
+func addTestVolume(t *testing.T, vm *Vm, name string) *VboxVolume {
+	volume := &VboxVolume{Name: name, Size: 10, Location: newfs.NewFolder(t.TempDir()), Format: "VDI"}
+	vm.volumes[name] = volume
+	return volume
+}
+
+func TestStartAndStop(t *testing.T) {
+	f := useFakeVbox(t)
+	ctx := context.Background()
+	vm := newTestVm(t, ctx, "a", "18080:80")
+	volume := addTestVolume(t, vm, "data")
+	if err := vm.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if state := f.State(vm.Name()); state != "running" {
+		t.Errorf("state after start : %s, expected running", state)
+	}
+	rules := vm.info.NATRules()
+	if _, ok := rules["ssh"]; !ok {
+		t.Errorf("no ssh NAT rule in %v", rules)
+	}
+	if port := rules["PRODUCT-80"]; port != "18080" {
+		t.Errorf("PRODUCT-80 NAT rule exposes host port %q, expected 18080", port)
+	}
+	if port, ok := vm.info.AttachedVolumes()[volume.File().String()]; !ok || port != 1 {
+		t.Errorf("volume attached on port %d (%v), expected 1", port, ok)
+	}
+	if _, ok := vm.info.SharedFolders()["xbee"]; !ok {
+		t.Errorf("no xbee shared folder in %v", vm.info.SharedFolders())
+	}
+	if machine := vm.info.Machine(); machine.Memory != 1024 || machine.CPUs != 2 {
+		t.Errorf("memory %d and cpus %d, expected 1024 and 2", machine.Memory, machine.CPUs)
+	}
+
+	// as Provider.Down does
+	if err := (Vms{vm}).Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.AfterDown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if state := f.State(vm.Name()); state != "poweroff" {
+		t.Errorf("state after stop : %s, expected poweroff", state)
+	}
+	if rules := vm.info.NATRules(); len(rules) != 0 {
+		t.Errorf("NAT rules left after stop : %v", rules)
+	}
+
+	// a second start finds its volume and shared folder already there
+	if err := vm.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rules := vm.info.NATRules(); len(rules) != 2 {
+		t.Errorf("NAT rules after second start : %v, expected ssh and PRODUCT-80", rules)
+	}
+	if volumes := vm.info.AttachedVolumes(); len(volumes) != 1 {
+		t.Errorf("volumes after second start : %v, expected data only", volumes)
+	}
+}
+
+func TestDestroyKeepsVolumes(t *testing.T) {
+	useFakeVbox(t)
+	ctx := context.Background()
+	vm := newTestVm(t, ctx, "a")
+	volume := addTestVolume(t, vm, "data")
+	if err := vm.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	folder := vm.Folder().String()
+	if err := vm.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	registered, err := ListRegisteredVms(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registered) != 0 {
+		t.Errorf("vms still registered after destroy : %v", registered)
+	}
+	if _, err := os.Stat(folder); !os.IsNotExist(err) {
+		t.Errorf("folder %s not deleted : %v", folder, err)
+	}
+	if _, err := os.Stat(volume.File().String()); err != nil {
+		t.Errorf("volume deleted with the vm : %v", err)
+	}
+}
+
+func TestTagRecordsHostInExtradata(t *testing.T) {
+	useFakeVbox(t)
+	ctx := context.Background()
+	vm := newTestVm(t, ctx, "a")
+	extra, err := vm.Vbox().ExtraData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra[tagHost] != "a" {
+		t.Errorf("extradata %s is %q, expected a", tagHost, extra[tagHost])
+	}
+	if extra[tagCreatedAt] == "" {
+		t.Errorf("no extradata %s", tagCreatedAt)
+	}
+}
+
+func TestRollbackUndoesCreation(t *testing.T) {
+	useFakeVbox(t)
+	ctx := context.Background()
+	vm := newTestVm(t, ctx, "a")
+	tx := &rollback{vm: vm}
+	tx.undoSystemDisk(vm.VirtualDisk().String())
+	tx.undoRegistration()
+	if err := tx.run(cmd.Error("start failed")); err == nil {
+		t.Fatal("rollback returned no error")
+	}
+	registered, err := ListRegisteredVms(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registered) != 0 {
+		t.Errorf("vms still registered after rollback : %v", registered)
+	}
+	if _, err := os.Stat(vm.VirtualDisk().String()); !os.IsNotExist(err) {
+		t.Errorf("system disk not deleted : %v", err)
+	}
+}
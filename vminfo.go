@@ -3,72 +3,59 @@ package virtualbox
 import (
 	"context"
 	"fmt"
-	"github.com/iodasolutions/xbee-common/constants"
-	"strconv"
+	"github.com/iodasolutions/xbee-common/cmd"
 	"strings"
 )
 
 type vminfo struct {
-	infos map[string]string //raw
+	machine *MachineInfo // nil when the VM does not exist
 
 	natRules map[string]string
 }
 
-// VmInfoFor returns a map containing output from command:
+// VmInfoFor reads the configuration of vmName with:
 // vboxmanage showvminfo <Name> --machinereadable
-// surrounding quotation marks are removed, only data in form key=value are kept.
-func VmInfoFor(ctx context.Context, vmName string) *vminfo {
-	out, err := VboxFrom(vmName).showVmInfo(ctx)
+// It is empty when the VM does not exist. Other failures are errors: the state of the VM is unknown.
+func VmInfoFor(ctx context.Context, vmName string) (*vminfo, *cmd.XbeeError) {
+	machine, err := ShowMachineInfo(ctx, vmName)
 	if err != nil {
-		aMap := make(map[string]string)
-		aMap["VMState"] = "UNDEFINED" //No VM
-		return &vminfo{
-			infos: aMap,
-		}
-	} else {
-		parser := &Parser{content: out}
-		return &vminfo{
-			infos: parser.asMap(),
+		if err.NotFound() {
+			return &vminfo{}, nil
 		}
+		return nil, cmd.Error("cannot read configuration of vm %s (%s) : %s", vmName, err.Kind, err.Message())
 	}
+	return &vminfo{machine: machine}, nil
 }
 
-func (info *vminfo) State() string {
-	aState := info.infos["VMState"]
-	if aState == "running" {
-		return constants.State.Up
-	} else if (aState == "poweroff") || (aState == "aborted") {
-		return constants.State.Down
+// Machine returns the parsed configuration, an empty one when the VM does not exist.
+func (info *vminfo) Machine() *MachineInfo {
+	if info.machine == nil {
+		return &MachineInfo{Values: map[string]string{}}
 	}
-	return constants.State.NotExisting
+	return info.machine
+}
+
+// State is constants.State.Up, Down or NotExisting, or the VirtualBox state when it is none of them.
+func (info *vminfo) State() string {
+	return info.MachineState().ProviderState()
+}
+
+func (info *vminfo) MachineState() MachineState {
+	return MachineState(info.Machine().State)
 }
 
 func (info *vminfo) SharedFolders() map[string]string {
-	var key, value string
 	result := map[string]string{}
-	for k := range info.infos {
-		if strings.HasPrefix(k, "SharedFolderNameMachineMapping") {
-			key = info.infos[k]
-		}
-		if strings.HasPrefix(k, "SharedFolderPathMachineMapping") {
-			value = info.infos[k]
-		}
-		if key != "" && value != "" {
-			result[key] = value
-			key = ""
-			value = ""
-		}
+	for _, sf := range info.Machine().SharedFolders {
+		result[sf.Name] = sf.HostPath
 	}
 	return result
 }
 
 func (info *vminfo) HostPorts() string {
-	keys := info.allKeyStartingWith("Forwarding(")
-	for _, key := range keys {
-		value := info.infos[key]
-		portS := info.portHelper("22", value)
-		if portS != "" {
-			return portS
+	for _, rule := range info.Machine().Forwardings() {
+		if rule.GuestPort == "22" {
+			return rule.HostPort
 		}
 	}
 	return ""
@@ -80,36 +67,16 @@ func extraValueFrom(line string) string {
 	return strings.TrimPrefix(trimmed, "Value: ")
 }
 
-func (info *vminfo) portHelper(guestPort string, s string) string {
-	if strings.HasSuffix(s, fmt.Sprintf(",%s", guestPort)) {
-		splitted := strings.Split(s, ",")
-		portS := splitted[3]
-		return portS
-	}
-	return ""
-}
-
 func (info *vminfo) NATRules() map[string]string { // map rule name to exposed host port
 	if info.natRules == nil {
 		info.natRules = make(map[string]string)
-		keys := info.allKeyStartingWith("Forwarding(")
-		for _, key := range keys {
-			value := info.infos[key]
-			splitted := strings.Split(value, ",")
-			info.natRules[splitted[0]] = splitted[3]
+		for _, rule := range info.Machine().Forwardings() {
+			info.natRules[rule.Name] = rule.HostPort
 		}
 	}
 	return info.natRules
 }
 
-func (info *vminfo) allKeyStartingWith(name string) (result []string) {
-	for key := range info.infos {
-		if strings.HasPrefix(key, name) {
-			result = append(result, key)
-		}
-	}
-	return
-}
 func (info *vminfo) NextAvailableSATAControllerPort() int {
 	attachedVolumes := info.AttachedVolumes()
 	maxPort := 0
@@ -123,19 +90,11 @@ func (info *vminfo) NextAvailableSATAControllerPort() int {
 
 func (info *vminfo) AttachedVolumes() map[string]int { // map filename to port number in sata controller
 	result := make(map[string]int)
-	for key := range info.infos {
-		if strings.HasPrefix(key, "SATA-") && !strings.HasPrefix(key, "SATA-ImageUUID") {
-			key1 := key[strings.Index(key, "-")+1:]
-			indexS := key1[:strings.Index(key1, "-")]
-			index, err := strconv.Atoi(indexS)
-			if err != nil {
-				panic(fmt.Errorf("unexpected error when extracting port number from %s", key))
-			}
-			if index != 0 {
-				value := info.infos[key]
-				if value != "none" {
-					result[value] = index
-				}
+	if sata := info.Machine().Controller("SATA"); sata != nil {
+		for _, a := range sata.Attachments {
+			// port 0 is the system disk
+			if a.Port != 0 {
+				result[a.Medium] = a.Port
 			}
 		}
 	}
@@ -169,18 +128,16 @@ func (info *vminfo) natKeyFor(port string) string {
 }
 
 func (info *vminfo) MacAddress(n int) string {
-	key := fmt.Sprintf("macaddress%d", n)
-	if value, ok := info.infos[key]; ok {
-		return fmt.Sprintf("%s:%s:%s:%s:%s:%s", value[0:2], value[2:4], value[4:6], value[6:8], value[8:10], value[10:12])
+	if nic := info.Machine().NIC(n); nic != nil {
+		return nic.MACAddress
 	}
 	return ""
 }
 
 func (info *vminfo) IsSeedAttached() bool {
-	value, ok := info.infos["IDE-0-0"]
-	return ok && value != "none"
+	return info.Machine().Controller("IDE").Attachment(0, 0) != nil
 }
+
 func (info *vminfo) IsGuestAdditionAttached() bool {
-	value, ok := info.infos["IDE-0-1"]
-	return ok && value != "none"
+	return info.Machine().Controller("IDE").Attachment(0, 1) != nil
 }
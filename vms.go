@@ -2,19 +2,33 @@ package virtualbox
 
 import (
 	"context"
+	"fmt"
 	"github.com/iodasolutions/xbee-common/cmd"
 	"github.com/iodasolutions/xbee-common/constants"
 	"github.com/iodasolutions/xbee-common/log2"
 	"github.com/iodasolutions/xbee-common/provider"
 	"github.com/iodasolutions/xbee-common/util"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type Vms []*Vm
 
-func VmsFrom(ctx context.Context) (result Vms) {
-	for vm := range vmGenerator(ctx) {
+func VmsFrom(ctx context.Context) (result Vms, err *cmd.XbeeError) {
+	vols := map[string]*VboxVolume{}
+	for _, vol := range provider.VolumesForEnv() {
+		if vols[vol.Name], err = VboxVolumeFrom(vol); err != nil {
+			return
+		}
+	}
+	var list []util.Executor
+	for vm := range vmGenerator(ctx, vols) {
 		result = append(result, vm)
+		list = append(list, vm.refresh)
 	}
+	// a VM whose state is unknown must not be taken for a missing one
+	err = util.Execute(ctx, list...)
 	return
 }
 
@@ -45,6 +59,88 @@ func (vms Vms) Down() (result Vms, other Vms) {
 	return
 }
 
+func (vms Vms) Suspended() (result Vms, other Vms) {
+	for _, vm := range vms {
+		if vm.info.MachineState().Suspended() {
+			result = append(result, vm)
+		} else {
+			other = append(other, vm)
+		}
+	}
+	return
+}
+
+// Settle waits for VMs in transitional states, and powers off stuck ones.
+func (vms Vms) Settle(ctx context.Context) *cmd.XbeeError {
+	var list []util.Executor
+	for _, vm := range vms {
+		vm := vm
+		list = append(list, func(ctx context.Context) *cmd.XbeeError {
+			if err := vm.settle(ctx); err != nil {
+				return err
+			}
+			if vm.info.MachineState().Stuck() {
+				return vm.ensureOff(ctx)
+			}
+			return nil
+		})
+	}
+	return util.Execute(ctx, list...)
+}
+
+// Stop shuts VMs down in parallel.
+func (vms Vms) Stop(ctx context.Context) *cmd.XbeeError {
+	var list []util.Executor
+	for _, vm := range vms {
+		list = append(list, vm.stop)
+	}
+	return util.Execute(ctx, list...)
+}
+
+// Running returns running and paused VMs, those which can be suspended.
+func (vms Vms) Running() (result Vms, other Vms) {
+	for _, vm := range vms {
+		if state := vm.info.MachineState(); state == MachineRunning || state == MachinePaused {
+			result = append(result, vm)
+		} else {
+			other = append(other, vm)
+		}
+	}
+	return
+}
+
+// Suspend saves VMs to disk in parallel.
+func (vms Vms) Suspend(ctx context.Context) *cmd.XbeeError {
+	var list []util.Executor
+	for _, vm := range vms {
+		list = append(list, vm.suspend)
+	}
+	return util.Execute(ctx, list...)
+}
+
+// Resume restarts suspended VMs where they stopped in parallel, and waits until SSH is open and probes pass.
+func (vms Vms) Resume(ctx context.Context) *cmd.XbeeError {
+	var list []util.Executor
+	for _, vm := range vms {
+		vm := vm
+		list = append(list, func(ctx context.Context) *cmd.XbeeError {
+			if err := vm.resume(ctx); err != nil {
+				return err
+			}
+			if !DryRun() {
+				if err := vm.waitSSH(ctx); err != nil {
+					return err
+				}
+				if err := vm.waitProbes(ctx); err != nil {
+					return err
+				}
+			}
+			return vm.runHooks(ctx, HookPostStart)
+		})
+	}
+	return util.Execute(ctx, list...)
+}
+
 func (vms Vms) NotExistingOrDown() (result Vms, other Vms) {
 	for _, vm := range vms {
 		if vm.NotExistingOrDown() {
@@ -65,11 +161,7 @@ func (vms Vms) NotExisting() (result Vms) {
 	return
 }
 
-func vmGenerator(ctx context.Context) <-chan *Vm {
-	vols := map[string]*VboxVolume{}
-	for _, vol := range provider.VolumesForEnv() {
-		vols[vol.Name] = VboxVolumeFrom(vol)
-	}
+func vmGenerator(ctx context.Context, vols map[string]*VboxVolume) <-chan *Vm {
 	var channels []<-chan *Vm
 	for _, h := range provider.Hosts() {
 		ch := make(chan *Vm)
@@ -77,7 +169,7 @@ func vmGenerator(ctx context.Context) <-chan *Vm {
 		go func(h *provider.XbeeHost) {
 			defer close(ch)
 			var vm *Vm
-			vm, err := fromHost(ctx, h)
+			vm, err := fromHost(h)
 			if err != nil {
 				log2.Errorf(err.Error())
 			} else {
@@ -92,50 +184,37 @@ func vmGenerator(ctx context.Context) <-chan *Vm {
 	return util.Multiplex(ctx, channels...)
 }
 
-func (vms Vms) Up(ctx context.Context) (err *cmd.XbeeError) {
+// Up creates or starts down and not existing VMs in parallel, each one until its guest is ready.
+// At most XBEE_VBOX_PARALLELISM VMs (4 by default, 0 for no limit) are created or started at a time,
+// waiting for guests is not limited. A failing VM does not stop others: failures are reported together.
+func (vms Vms) Up(ctx context.Context) *cmd.XbeeError {
 	notExistinOrDown, _ := vms.NotExistingOrDown()
-	for _, vm := range notExistinOrDown {
-		if vm.NotExisting() {
-			vm.InitiallyNotExisting = true
-			if err := vm.prepareForCreation(ctx); err != nil {
-				return err
-			}
-		} else {
-			vm.InitiallyDown = true
-		}
-		err = vm.Start(ctx)
-		if err != nil {
-			return
-		}
+	limit := envInt(envParallelism, 4)
+	if limit <= 0 || limit > len(notExistinOrDown) {
+		limit = len(notExistinOrDown)
 	}
+	slots := make(chan struct{}, limit)
+	var mu sync.Mutex
+	var failures []string
 	var list []util.Executor
 	for _, vm := range notExistinOrDown {
-		list = append(list, vm.waitSSH)
+		vm := vm
+		list = append(list, func(ctx context.Context) *cmd.XbeeError {
+			if err := vm.up(ctx, slots); err != nil {
+				log2.Errorf("%s : %v", vm.HostName, err)
+				mu.Lock()
+				defer mu.Unlock()
+				failures = append(failures, fmt.Sprintf("%s : %s", vm.HostName, strings.TrimSpace(err.Error())))
+			}
+			return nil
+		})
 	}
-	if err = util.Execute(ctx, list...); err != nil {
-		return
+	if err := util.Execute(ctx, list...); err != nil {
+		return err
 	}
-	for _, vm := range notExistinOrDown {
-		if vm.InitiallyNotExisting {
-			if err = vm.waitUntilCloudInitFinished(); err != nil {
-				return
-			}
-			if vm.guestAddition != nil {
-				if err = vm.conn.RunScript(GuestAdditionScript()); err != nil {
-					return
-				}
-				log2.Infof("%s : guest addition installed", vm.HostName)
-			}
-		}
-		if err = vm.conn.RunCommand("sudo mkdir -p /root/.xbee/cache-artefacts && sudo mount -t vboxsf xbee /root/.xbee/cache-artefacts"); err != nil {
-			return
-		}
-		log2.Infof("shared folder xbee mounted")
-		if vm.InitiallyNotExisting {
-			if err = vm.conn.RunCommand("sudo cp /root/.xbee/cache-artefacts/s3.eu-west-3.amazonaws.com/xbee.repository.public/linux_amd64/xbee /usr/bin"); err != nil {
-				return
-			}
-		}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return cmd.Error("%d of %d hosts failed :\n%s", len(failures), len(notExistinOrDown), strings.Join(failures, "\n"))
 	}
 	return nil
 }
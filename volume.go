@@ -7,6 +7,7 @@ import (
 	"github.com/iodasolutions/xbee-common/log2"
 	"github.com/iodasolutions/xbee-common/newfs"
 	"github.com/iodasolutions/xbee-common/provider"
+	"strconv"
 	"strings"
 )
 
@@ -19,10 +20,14 @@ type VboxVolume struct {
 	Device string
 }
 
-func VboxVolumeFrom(vol *provider.XbeeVolume) *VboxVolume {
+func VboxVolumeFrom(vol *provider.XbeeVolume) (*VboxVolume, *cmd.XbeeError) {
 	result := &VboxVolume{}
 	if result.Location.String() == "" {
-		result.Location = newfs.Volumes()
+		location, err := hypervisorFolder(newfs.Volumes())
+		if err != nil {
+			return nil, err
+		}
+		result.Location = location
 	} else {
 		result.Location = newfs.NewFolder(newfs.CWD().ResolvePath(result.Location.String()))
 	}
@@ -31,17 +36,21 @@ func VboxVolumeFrom(vol *provider.XbeeVolume) *VboxVolume {
 	}
 	result.Name = vol.Name
 	result.Size = vol.Size * 1024 //virtualbox expect size in Mb
-	return result
+	return result, nil
 }
 
 func (v *VboxVolume) File() newfs.File {
 	return v.Location.ChildFile(fmt.Sprintf("%s.%s", v.Name, strings.ToLower(v.Format)))
 }
 
+// create makes a writethrough medium: snapshots of VMs leave it out, restoring one does not roll it back.
 func (v *VboxVolume) create(ctx context.Context) *cmd.XbeeError {
 	log2.Infof("Create medium %s on host", v.File())
-	err := VboxFrom("").CreateMedium(ctx, v.File(), v.Size, v.Format)
-	return err
+	vbox := VboxFrom("")
+	if err := vbox.CreateMedium(ctx, v.File(), v.Size, v.Format); err != nil {
+		return err
+	}
+	return vbox.SetMediumType(ctx, v.File(), "writethrough")
 }
 func (v *VboxVolume) Delete(ctx context.Context) *cmd.XbeeError {
 	log2.Infof("Delete medium %s on host", v.File())
@@ -80,7 +89,49 @@ func (v *VboxVolume) EnsureHostVolumeDetached(ctx context.Context, vm *Vm) error
 }
 
 type Hdd struct { // information from vboxmanage
-	Location string
-	Format   string
-	Capacity string
+	UUID       string
+	Parent     string // UUID of the parent of a differencing disk, empty for a base disk
+	Location   string
+	Format     string
+	Capacity   string
+	State      string // created, inaccessible...
+	SizeOnDisk int64  // bytes
+	InUseBy    string // VMs using the disk, empty if none
+}
+
+// ListHdds returns disks of the virtualbox media registry, from VBoxManage list hdds --long.
+func ListHdds(ctx context.Context) ([]*Hdd, *cmd.XbeeError) {
+	out, err := VboxFrom("").execute(ctx, "list", "hdds", "--long")
+	if err != nil {
+		return nil, err
+	}
+	var result []*Hdd
+	for _, aMap := range (&Parser{content: out}).asList() {
+		result = append(result, &Hdd{
+			UUID:       aMap["UUID"],
+			Parent:     strings.TrimPrefix(aMap["Parent UUID"], "base"),
+			Location:   aMap["Location"],
+			Format:     aMap["Storage format"],
+			Capacity:   aMap["Capacity"],
+			State:      aMap["State"],
+			SizeOnDisk: parseSize(aMap["Size on disk"]),
+			InUseBy:    aMap["In use by VMs"],
+		})
+	}
+	return result, nil
+}
+
+var sizeUnits = map[string]int64{"Bytes": 1, "KBytes": 1 << 10, "MBytes": 1 << 20, "GBytes": 1 << 30, "TBytes": 1 << 40}
+
+// parseSize reads sizes printed by VBoxManage, 2048 MBytes for example.
+func parseSize(s string) int64 {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return 0
+	}
+	value, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value * sizeUnits[fields[1]]
 }